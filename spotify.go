@@ -1,14 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 )
 type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
@@ -18,26 +44,275 @@ type TokenResponse struct {
 	Scope        string `json:"scope,omitempty"`
 }
 
+// TrackResponse and the other responses for an item found by q carry a
+// MatchScore saying how closely the result matches the query; see matchScore.
+// It is omitted when the item was looked up by id.
+//
+// With features=true a TrackResponse also has the track's audio features.
+// If they can't be fetched, for instance because Spotify restricts them for
+// the app, Partial and Warnings are set as for ArtistFullResponse instead.
 type TrackResponse struct {
-	Success bool      `json:"success"`
-	Track   TrackInfo `json:"track"`
+	Success    bool           `json:"success"`
+	Track      TrackInfo      `json:"track"`
+	MatchScore *float64       `json:"matchScore,omitempty"`
+	Features   *AudioFeatures `json:"features,omitempty"`
+	Partial    bool           `json:"partial,omitempty"`
+	Warnings   []string       `json:"warnings,omitempty"`
+}
+
+// AudioFeatures are Spotify's audio features for a track. Key is a pitch
+// class (0 is C, -1 unknown) and Mode is 1 for major and 0 for minor.
+type AudioFeatures struct {
+	Acousticness     float64 `json:"acousticness"`
+	Danceability     float64 `json:"danceability"`
+	Energy           float64 `json:"energy"`
+	Instrumentalness float64 `json:"instrumentalness"`
+	Liveness         float64 `json:"liveness"`
+	Speechiness      float64 `json:"speechiness"`
+	Valence          float64 `json:"valence"`
+	Loudness         float64 `json:"loudness"`
+	Tempo            float64 `json:"tempo"`
+	Key              int     `json:"key"`
+	Mode             int     `json:"mode"`
+	TimeSignature    int     `json:"timeSignature"`
 }
 
 type TrackInfo struct {
-	Name       string `json:"name"`
-	FullTitle  string `json:"fullTitle"`
-	ID         string `json:"id"`
-	URL        string `json:"url"`
-	PreviewURL string `json:"preview_url"`
-	Duration   string `json:"duration"`
-	DurationMs int    `json:"duration_ms"`
-	Explicit   bool   `json:"explicit"`
-	Popularity int    `json:"popularity"`
+	Name       string      `json:"name"`
+	FullTitle  string      `json:"fullTitle"`
+	ID         string      `json:"id"`
+	URL        string      `json:"url"`
+	PreviewURL string      `json:"preview_url"`
+	Duration   string      `json:"duration"`
+	DurationMs int         `json:"duration_ms"`
+	Explicit   bool        `json:"explicit"`
+	Popularity int         `json:"popularity"`
+	ISRC       string      `json:"isrc,omitempty"`
+	Album      *TrackAlbum `json:"album,omitempty"`
+
+	Restrictions *Restrictions `json:"restrictions,omitempty"`
+}
+
+// Restrictions explains why Spotify won't play a track or album. Reason is
+// "market" when it isn't available in the request's market, "product" when
+// it needs Premium and "explicit" when the user's settings block explicit
+// content. Spotify may add others.
+type Restrictions struct {
+	Reason string `json:"reason"`
+}
+
+// TrackAlbum is the compact album included in a TrackInfo with album=true.
+type TrackAlbum struct {
+	Name        string        `json:"name"`
+	ID          string        `json:"id"`
+	URL         string        `json:"url"`
+	ReleaseDate string        `json:"releaseDate"`
+	Artists     []ArtistBasic `json:"artists"`
+	Images      []ImageInfo   `json:"images"`
+}
+
+// TrackAlbumResponse is returned by /spotify/track/album: a track together
+// with every track of its album.
+type TrackAlbumResponse struct {
+	Success    bool                `json:"success"`
+	Track      TrackInfo           `json:"track"`
+	MatchScore *float64            `json:"matchScore,omitempty"`
+	Album      ArtistBasic         `json:"album"`
+	Tracks     []AlbumSiblingTrack `json:"tracks"`
+}
+
+// TrackArtistsResponse is returned by /spotify/track/artists: a track with
+// its album and every credited artist resolved to a full ArtistInfo.
+type TrackArtistsResponse struct {
+	Success      bool         `json:"success"`
+	Track        TrackInfo    `json:"track"`
+	MatchScore   *float64     `json:"matchScore,omitempty"`
+	Artists      []ArtistInfo `json:"artists"`
+	AlbumArtists []ArtistInfo `json:"albumArtists"`
+	Partial      bool         `json:"partial,omitempty"`
+	Warnings     []string     `json:"warnings,omitempty"`
+}
+
+// AlbumSiblingTrack is an album track; Current marks the requested one.
+type AlbumSiblingTrack struct {
+	TrackBasic
+	ID      string `json:"id"`
+	Current bool   `json:"current"`
+}
+
+// TrackMarketsResponse is returned by /spotify/track/markets. Markets maps
+// each requested market to whether the track can be played there, and
+// Relinked maps the markets where Spotify plays a different copy of the
+// track, such as a regional release, to that copy's ID.
+type TrackMarketsResponse struct {
+	Success  bool              `json:"success"`
+	ID       string            `json:"id"`
+	Markets  map[string]bool   `json:"markets"`
+	Relinked map[string]string `json:"relinked,omitempty"`
+	Partial  bool              `json:"partial,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// TracksResponse lists tracks in the order they were requested, so clients
+// can match them to their input by index.
+type TracksResponse struct {
+	Success bool         `json:"success"`
+	Tracks  []BatchTrack `json:"tracks"`
+}
+
+// BatchTrack is a track from a batch lookup. ID is always the requested ID.
+// Tracks that are unknown or unavailable in the market have Found false and
+// no other fields.
+type BatchTrack struct {
+	ID    string `json:"id"`
+	Found bool   `json:"found"`
+	*TrackInfo
+}
+
+// ArtistsTopTracksResponse is returned by /spotify/artists/top-tracks, most
+// popular first. Partial and Warnings are set as for ArtistFullResponse.
+type ArtistsTopTracksResponse struct {
+	Success  bool             `json:"success"`
+	Tracks   []ArtistTopTrack `json:"tracks"`
+	Partial  bool             `json:"partial,omitempty"`
+	Warnings []string         `json:"warnings,omitempty"`
+	Complete *bool            `json:"complete,omitempty"`
+}
+
+// ArtistTopTrack is a track with the ids of the requested artists it is a
+// top track of, more than one for collaborations.
+type ArtistTopTrack struct {
+	TrackInfo
+	TopTrackOf []string `json:"topTrackOf"`
+}
+
+// ISRCTracksResponse lists the tracks found for each ISRC in the order they
+// were requested. ISRC is the normalized code. ISRCs without a match have
+// Found false; Error is set instead when the search for one failed.
+type ISRCTracksResponse struct {
+	Success  bool        `json:"success"`
+	Tracks   []ISRCTrack `json:"tracks"`
+	Partial  bool        `json:"partial,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+type ISRCTrack struct {
+	ISRC  string `json:"isrc"`
+	Found bool   `json:"found"`
+	*TrackInfo
+}
+
+// EpisodesResponse lists episodes in the order they were requested. IDs that
+// are unknown or unavailable in the market are null.
+type EpisodesResponse struct {
+	Success  bool           `json:"success"`
+	Episodes []*EpisodeInfo `json:"episodes"`
+}
+
+type EpisodeInfo struct {
+	Name        string      `json:"name"`
+	ID          string      `json:"id"`
+	URL         string      `json:"url"`
+	Show        string      `json:"show"`
+	Description string      `json:"description"`
+	ReleaseDate string      `json:"releaseDate"`
+	Duration    string      `json:"duration"`
+	DurationMs  int         `json:"duration_ms"`
+	Explicit    bool        `json:"explicit"`
+	Images      []ImageInfo `json:"images"`
+}
+
+// AudiobookChaptersResponse is a page of an audiobook's chapters, returned
+// by /spotify/audiobook/chapters. Next and Previous are Spotify's paging
+// URLs, which /spotify/page follows.
+type AudiobookChaptersResponse struct {
+	Success  bool          `json:"success"`
+	ID       string        `json:"id"`
+	Chapters []ChapterInfo `json:"chapters"`
+	Total    int           `json:"total"`
+	Next     string        `json:"next,omitempty"`
+	Previous string        `json:"previous,omitempty"`
+}
+
+type ChapterInfo struct {
+	Name          string      `json:"name"`
+	ID            string      `json:"id"`
+	URL           string      `json:"url"`
+	ChapterNumber int         `json:"chapterNumber"`
+	PreviewURL    string      `json:"preview_url"`
+	Duration      string      `json:"duration"`
+	DurationMs    int         `json:"duration_ms"`
+	Explicit      bool        `json:"explicit"`
+	ReleaseDate   string      `json:"releaseDate"`
+	Images        []ImageInfo `json:"images"`
+}
+
+// ShowsResponse lists shows in the order they were requested. IDs that are
+// unknown or unavailable in the market are null.
+type ShowsResponse struct {
+	Success bool        `json:"success"`
+	Shows   []*ShowInfo `json:"shows"`
+}
+
+type ShowInfo struct {
+	Name          string      `json:"name"`
+	ID            string      `json:"id"`
+	URL           string      `json:"url"`
+	Publisher     string      `json:"publisher"`
+	Description   string      `json:"description"`
+	TotalEpisodes int         `json:"totalEpisodes"`
+	Explicit      bool        `json:"explicit"`
+	Languages     []string    `json:"languages"`
+	Images        []ImageInfo `json:"images"`
+}
+
+// ResolveResponse is returned by /spotify/resolve.
+type ResolveResponse struct {
+	Success bool `json:"success"`
+	ResolvedLink
+}
+
+// ResolvedLink is the item behind a share link. Item is a TrackInfo,
+// AlbumInfo, SimilarArtist, PlaylistInfo, ShowInfo or EpisodeInfo depending
+// on Type, and URL is the clean link.
+type ResolvedLink struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id"`
+	URL  string      `json:"url"`
+	Item interface{} `json:"item"`
+}
+
+// ResolveBatchResponse lists the links of a /spotify/resolve/batch request
+// in the order they were given. Links that couldn't be resolved have Error
+// set instead of the ResolvedLink fields.
+type ResolveBatchResponse struct {
+	Success bool            `json:"success"`
+	Results []BatchResolved `json:"results"`
+}
+
+type BatchResolved struct {
+	Input string `json:"input"`
+	*ResolvedLink
+	Error string `json:"error,omitempty"`
+}
+
+// NormalizeIDsResponse is returned by /spotify/normalize-ids. IDs holds the
+// bare ids of the accepted inputs, in input order.
+type NormalizeIDsResponse struct {
+	Success  bool         `json:"success"`
+	IDs      []string     `json:"ids"`
+	Rejected []RejectedID `json:"rejected"`
+}
+
+type RejectedID struct {
+	Input  string `json:"input"`
+	Reason string `json:"reason"`
 }
 
 type ArtistShortResponse struct {
-	Success bool       `json:"success"`
-	Artist  ArtistInfo `json:"artist"`
+	Success    bool       `json:"success"`
+	Artist     ArtistInfo `json:"artist"`
+	MatchScore *float64   `json:"matchScore,omitempty"`
 }
 
 type ArtistInfo struct {
@@ -53,11 +328,18 @@ type ArtistInfo struct {
     Albums           int      `json:"albums"`
     Singles         int      `json:"singles"`
     Compilations    int      `json:"compilations"`
+    // Color is the dominant color of Image, e.g. "#3a2f28", with color=true.
+    Color           string   `json:"color,omitempty"`
 }
 
+// ArtistFullResponse and ArtistStatsResponse set Partial, and name each
+// missing part in Warnings, when some of the calls behind them failed.
 type ArtistFullResponse struct {
-	Success bool             `json:"success"`
-	Artist  ArtistFullInfo  `json:"artist"`
+	Success    bool           `json:"success"`
+	Artist     ArtistFullInfo `json:"artist"`
+	MatchScore *float64       `json:"matchScore,omitempty"`
+	Partial    bool           `json:"partial,omitempty"`
+	Warnings   []string       `json:"warnings,omitempty"`
 }
 
 type ArtistFullInfo struct {
@@ -65,6 +347,25 @@ type ArtistFullInfo struct {
 	TopTracks []TopTrackInfo  `json:"topTracks"`
 	Albums    []AlbumBasicInfo `json:"albums"`
 	AlbumStats AlbumStats      `json:"albumStats"`
+	AlbumsNext string          `json:"albumsNext,omitempty"`
+	Color      string          `json:"color,omitempty"`
+}
+
+type ArtistStatsResponse struct {
+	Success    bool            `json:"success"`
+	Artist     ArtistStatsInfo `json:"artist"`
+	MatchScore *float64        `json:"matchScore,omitempty"`
+	Partial    bool            `json:"partial,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	Complete   *bool           `json:"complete,omitempty"`
+}
+
+// ArtistStatsInfo is ArtistInfo counted over the artist's whole catalogue,
+// plus the full top tracks.
+type ArtistStatsInfo struct {
+	ArtistInfo
+	TopTracks  []TrackInfo `json:"topTracks"`
+	AlbumStats AlbumStats  `json:"albumStats"`
 }
 
 type TopTrackInfo struct {
@@ -77,6 +378,117 @@ type AlbumBasicInfo struct {
 	Type string `json:"type"`
 }
 
+// ArtistTrackCountResponse is returned by /spotify/artist/track-count.
+type ArtistTrackCountResponse struct {
+	Success    bool     `json:"success"`
+	Artist     string   `json:"artist"`
+	MatchScore *float64 `json:"matchScore,omitempty"`
+	ArtistTrackCounts
+}
+
+// ArtistTrackCounts is the part of ArtistTrackCountResponse that is cached.
+// Releases and Tracks break the catalogue down by album type.
+type ArtistTrackCounts struct {
+	TotalTracks int        `json:"totalTracks"`
+	Releases    AlbumStats `json:"releases"`
+	Tracks      AlbumStats `json:"tracks"`
+}
+
+// ArtistLatestResponse is returned by /spotify/artist/latest.
+type ArtistLatestResponse struct {
+	Success    bool      `json:"success"`
+	Artist     string    `json:"artist"`
+	MatchScore *float64  `json:"matchScore,omitempty"`
+	Release    AlbumInfo `json:"release"`
+}
+
+// ArtistGenresResponse is returned by /spotify/artist/genres. Families groups
+// the artist's genres by broad family, largest first; Unclassified lists
+// those that match no bundled genre.
+type ArtistGenresResponse struct {
+	Success      bool          `json:"success"`
+	Artist       string        `json:"artist"`
+	MatchScore   *float64      `json:"matchScore,omitempty"`
+	Genres       []ArtistGenre `json:"genres"`
+	Families     []GenreFamily `json:"families"`
+	Unclassified []string      `json:"unclassified"`
+}
+
+// ArtistGenre is one of an artist's genres. Parents lists its broader
+// genres, nearest first, ending with Family; both are empty when the genre
+// is unclassified, and Parents also when it is a family itself.
+type ArtistGenre struct {
+	Name    string   `json:"name"`
+	Parents []string `json:"parents"`
+	Family  string   `json:"family,omitempty"`
+}
+
+type GenreFamily struct {
+	Family string   `json:"family"`
+	Genres []string `json:"genres"`
+}
+
+// ArtistExportResponse is returned by /spotify/artist/export. Partial and
+// Warnings are set as for ArtistFullResponse.
+type ArtistExportResponse struct {
+	Success    bool     `json:"success"`
+	MatchScore *float64 `json:"matchScore,omitempty"`
+	ArtistExport
+	Partial  bool     `json:"partial,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Complete *bool    `json:"complete,omitempty"`
+}
+
+// ArtistExport is the part of ArtistExportResponse that is cached. Albums
+// hold every track, so their TracksNext is always empty.
+type ArtistExport struct {
+	Artist         ArtistInfo      `json:"artist"`
+	TopTracks      []TrackInfo     `json:"topTracks"`
+	RelatedArtists []SimilarArtist `json:"relatedArtists"`
+	Albums         []AlbumInfo     `json:"albums"`
+	ExportedAt     time.Time       `json:"exportedAt"`
+}
+
+// AppearsOnResponse is returned by /spotify/artist/appears-on: albums by
+// other artists that the artist is featured on.
+type AppearsOnResponse struct {
+	Success    bool             `json:"success"`
+	Artist     string           `json:"artist"`
+	MatchScore *float64         `json:"matchScore,omitempty"`
+	Albums     []AppearsOnAlbum `json:"albums"`
+	Total      int              `json:"total"`
+	Next       string           `json:"next,omitempty"`
+}
+
+type AppearsOnAlbum struct {
+	Name        string        `json:"name"`
+	ID          string        `json:"id"`
+	Artists     []ArtistBasic `json:"artists"`
+	ReleaseDate string        `json:"releaseDate"`
+	Type        string        `json:"type"`
+	URL         string        `json:"url"`
+}
+
+// SimilarArtistsResponse is returned by /spotify/artist/similar. Partial and
+// Warnings are set as for ArtistFullResponse.
+type SimilarArtistsResponse struct {
+	Success    bool            `json:"success"`
+	Artist     string          `json:"artist"`
+	MatchScore *float64        `json:"matchScore,omitempty"`
+	Artists    []SimilarArtist `json:"artists"`
+	Partial    bool            `json:"partial,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+}
+
+type SimilarArtist struct {
+	Name       string   `json:"name"`
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Image      string   `json:"image"`
+	Genres     []string `json:"genres"`
+	Popularity int      `json:"popularity"`
+}
+
 type AlbumStats struct {
 	Album        int `json:"album"`
 	Single       int `json:"single"`
@@ -84,8 +496,9 @@ type AlbumStats struct {
 }
 
 type AlbumResponse struct {
-	Success bool       `json:"success"`
-	Album   AlbumInfo `json:"album"`
+	Success    bool      `json:"success"`
+	Album      AlbumInfo `json:"album"`
+	MatchScore *float64  `json:"matchScore,omitempty"`
 }
 
 type AlbumInfo struct {
@@ -98,7 +511,52 @@ type AlbumInfo struct {
 	Type        string        `json:"type"`
 	URL         string        `json:"url"`
 	Images      []ImageInfo   `json:"images"`
+	Thumbnail   *ImageInfo    `json:"thumbnail"`
+	Cover       *ImageInfo    `json:"cover"`
 	Tracks      []TrackBasic  `json:"tracks"`
+	TracksNext  string        `json:"tracksNext,omitempty"`
+	UPC         string        `json:"upc,omitempty"`
+
+	Restrictions *Restrictions `json:"restrictions,omitempty"`
+}
+
+// MoreAlbumsResponse is returned by /spotify/album/more: the most popular
+// other albums of the album's primary artist.
+type MoreAlbumsResponse struct {
+	Success    bool        `json:"success"`
+	Album      string      `json:"album"`
+	Artist     string      `json:"artist"`
+	MatchScore *float64    `json:"matchScore,omitempty"`
+	Albums     []MoreAlbum `json:"albums"`
+}
+
+// MoreAlbum is a compact album for "more from this artist" lists.
+type MoreAlbum struct {
+	Name        string     `json:"name"`
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	ReleaseDate string     `json:"releaseDate"`
+	TotalTracks int        `json:"totalTracks"`
+	Popularity  int        `json:"popularity"`
+	Thumbnail   *ImageInfo `json:"thumbnail"`
+	Cover       *ImageInfo `json:"cover"`
+}
+
+// AlbumEditionsResponse is returned by /spotify/album/upc.
+type AlbumEditionsResponse struct {
+	Success  bool           `json:"success"`
+	Editions []AlbumEdition `json:"editions"`
+}
+
+// AlbumEdition is one release of an album returned by /spotify/album/upc.
+type AlbumEdition struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	UPC         string `json:"upc"`
+	ReleaseDate string `json:"releaseDate"`
+	TotalTracks int    `json:"totalTracks"`
+	Type        string `json:"type"`
+	URL         string `json:"url"`
 }
 
 type ArtistBasic struct {
@@ -118,465 +576,8603 @@ type TrackBasic struct {
 	Duration    int    `json:"duration"`
 	TrackNumber int    `json:"trackNumber"`
 	URL         string `json:"url"`
+
+	// Popularity, Explicit and PreviewURL are only set on album tracks
+	// requested with enrich=true; see enrichTracks.
+	Popularity *int   `json:"popularity,omitempty"`
+	Explicit   *bool  `json:"explicit,omitempty"`
+	PreviewURL string `json:"preview_url,omitempty"`
 }
 
-type SpotifyClient struct {
-	ClientID     string
-	ClientSecret string
-	AccessToken  string
-	TokenType    string
-	ExpiresAt    time.Time
-	HTTPClient   *http.Client
+// UserResponse is returned by /spotify/user.
+type UserResponse struct {
+	Success bool        `json:"success"`
+	User    UserProfile `json:"user"`
 }
 
-func NewSpotifyClient(clientID, clientSecret string) *SpotifyClient {
-	return &SpotifyClient{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
-	}
+// UserProfile is a user's public profile. DisplayName falls back to the ID
+// for users who haven't set one, and Images is empty for users without a
+// profile picture.
+type UserProfile struct {
+	ID          string      `json:"id"`
+	DisplayName string      `json:"displayName"`
+	Followers   int         `json:"followers"`
+	URL         string      `json:"url"`
+	Images      []ImageInfo `json:"images"`
 }
 
-func (c *SpotifyClient) authenticate() error {
-	data := url.Values{}
-	data.Set("grant_type", "client_credentials")
+type PlaylistResponse struct {
+	Success    bool         `json:"success"`
+	Playlist   PlaylistInfo `json:"playlist"`
+	MatchScore *float64     `json:"matchScore,omitempty"`
+}
 
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
-	if err != nil {
-		return err
-	}
+type PlaylistInfo struct {
+	Name        string      `json:"name"`
+	ID          string      `json:"id"`
+	Description string      `json:"description"`
+	Public      bool        `json:"public"`
+	Owner       string      `json:"owner"`
+	URL         string      `json:"url"`
+	Images      []ImageInfo `json:"images"`
+	Thumbnail   *ImageInfo  `json:"thumbnail"`
+	Cover       *ImageInfo  `json:"cover"`
+	TotalTracks int         `json:"totalTracks"`
+	// Followers is only known for playlists looked up directly, not for
+	// search results.
+	Followers *int `json:"followers,omitempty"`
+}
 
-	auth := base64.StdEncoding.EncodeToString([]byte(c.ClientID + ":" + c.ClientSecret))
-	req.Header.Set("Authorization", "Basic "+auth)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// PlaylistImageResponse is returned by /spotify/playlist/image. Cover is
+// "mosaic" for covers Spotify generates from the first tracks' albums and
+// "uploaded" for ones the owner chose. Image is the image closest to the
+// requested size, and only set when one was requested.
+type PlaylistImageResponse struct {
+	Success bool        `json:"success"`
+	ID      string      `json:"id"`
+	Cover   string      `json:"cover,omitempty"`
+	Images  []ImageInfo `json:"images"`
+	Image   *ImageInfo  `json:"image,omitempty"`
+}
 
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// PlayerContextResponse describes what the logged-in user is playing and
+// where it is playing from. Context is null when playback didn't start from a
+// playlist, album, artist or show, e.g. for a single track.
+type PlayerContextResponse struct {
+	Success bool           `json:"success"`
+	Playing bool           `json:"playing"`
+	Track   *TrackInfo     `json:"track"`
+	Context *PlayerContext `json:"context"`
+}
 
-	var tokenResp TokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return err
-	}
+type PlayerContext struct {
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+}
 
-	c.AccessToken = tokenResp.AccessToken
-	c.TokenType = tokenResp.TokenType
-	c.ExpiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+// SimilarTracksResponse is returned by /spotify/track/similar.
+type SimilarTracksResponse struct {
+	Success    bool        `json:"success"`
+	Seed       string      `json:"seed"`
+	MatchScore *float64    `json:"matchScore,omitempty"`
+	Tracks     []TrackInfo `json:"tracks"`
+}
 
-	return nil
+// RecommendationsResponse is returned by /spotify/me/recommendations. Seeds
+// are the IDs of the user's top tracks that the recommendations are based on.
+type RecommendationsResponse struct {
+	Success bool        `json:"success"`
+	Seeds   []string    `json:"seeds"`
+	Tracks  []TrackInfo `json:"tracks"`
+
+	// SeedArtists and SeedGenres are set when the request gave them.
+	SeedArtists []string `json:"seedArtists,omitempty"`
+	SeedGenres  []string `json:"seedGenres,omitempty"`
 }
 
-func (c *SpotifyClient) ensureValidToken() error {
-	if c.AccessToken == "" || time.Now().After(c.ExpiresAt) {
-		return c.authenticate()
-	}
-	return nil
+// RecommendationsDryRunResponse is returned by /spotify/me/recommendations
+// with dry_run=true: the parameters that would be sent to Spotify, minus the
+// top-track seeds when the request gives none.
+type RecommendationsDryRunResponse struct {
+	Success    bool              `json:"success"`
+	Parameters map[string]string `json:"parameters"`
 }
 
-func (c *SpotifyClient) makeRequest(method, endpoint string) ([]byte, error) {
-	if err := c.ensureValidToken(); err != nil {
-		return nil, err
-	}
+// QueueResponse lists the logged-in user's current track and what is queued
+// to play after it.
+type QueueResponse struct {
+	Success bool        `json:"success"`
+	Current *TrackInfo  `json:"current"`
+	Queue   []TrackInfo `json:"queue"`
+}
 
-	req, err := http.NewRequest(method, "https://api.spotify.com/v1"+endpoint, nil)
-	if err != nil {
-		return nil, err
-	}
+type DevicesResponse struct {
+	Success bool         `json:"success"`
+	Devices []DeviceInfo `json:"devices"`
+}
 
-	req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+// SavedAlbumsResponse is a page of the albums in the logged-in user's
+// library, most recently saved first. Next and Previous are Spotify's paging
+// URLs.
+type SavedAlbumsResponse struct {
+	Success  bool         `json:"success"`
+	Albums   []SavedAlbum `json:"albums"`
+	Total    int          `json:"total"`
+	Next     string       `json:"next,omitempty"`
+	Previous string       `json:"previous,omitempty"`
+}
 
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// SavedAlbum is an album as returned by /spotify/album, plus when the user
+// saved it.
+type SavedAlbum struct {
+	AddedAt string `json:"addedAt"`
+	AlbumInfo
+}
 
-	return io.ReadAll(resp.Body)
+// DeviceInfo describes one of the user's Spotify Connect devices. Volume is
+// null for devices whose volume can't be controlled.
+type DeviceInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	IsActive bool   `json:"isActive"`
+	Volume   *int   `json:"volume"`
 }
 
-func handleSpotifySongs(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Missing query parameter 'q'", http.StatusBadRequest)
-		return
-	}
+// The spotify* types mirror the parts of Spotify Web API objects that this
+// service uses. Responses are decoded straight into them, so counts and
+// durations are parsed as exact integers and IDs always stay strings; nothing
+// passes through float64.
 
-	client := NewSpotifyClient(clientID, clientSecret)
-	
-	// Search for tracks
-	data, err := client.makeRequest("GET", "/search?q="+url.QueryEscape(query)+"&type=track&limit=1")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyExternalURLs struct {
+	Spotify string `json:"spotify"`
+}
 
-	var searchResult map[string]interface{}
-	if err := json.Unmarshal(data, &searchResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyImage struct {
+	URL    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
 
-	tracks := searchResult["tracks"].(map[string]interface{})
-	items := tracks["items"].([]interface{})
-	if len(items) == 0 {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "No tracks found",
-		})
-		return
-	}
+type spotifySimpleArtist struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	ExternalURLs spotifyExternalURLs `json:"external_urls"`
+}
 
-	track := items[0].(map[string]interface{})
-	response := TrackResponse{
-		Success: true,
-		Track: TrackInfo{
-			Name:       track["name"].(string),
-			ID:         track["id"].(string),
-			URL:        track["external_urls"].(map[string]interface{})["spotify"].(string),
-			Duration:   formatDuration(int(track["duration_ms"].(float64))),
-			DurationMs: int(track["duration_ms"].(float64)),
-			Popularity: int(track["popularity"].(float64)),
-		},
-	}
+type spotifyArtist struct {
+	spotifySimpleArtist
+	Genres    []string `json:"genres"`
+	Followers struct {
+		Total int `json:"total"`
+	} `json:"followers"`
+	Popularity int            `json:"popularity"`
+	Images     []spotifyImage `json:"images"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+type spotifyTrack struct {
+	ID           string                `json:"id"`
+	Name         string                `json:"name"`
+	Artists      []spotifySimpleArtist `json:"artists"`
+	DurationMs   int                   `json:"duration_ms"`
+	Explicit     bool                  `json:"explicit"`
+	Popularity   int                   `json:"popularity"`
+	PreviewURL   string                `json:"preview_url"`
+	TrackNumber  int                   `json:"track_number"`
+	ExternalURLs spotifyExternalURLs   `json:"external_urls"`
+	ExternalIDs  map[string]string     `json:"external_ids"`
+	Album        *spotifyAlbum         `json:"album"`
+
+	// AvailableMarkets is only set when the track is fetched without a
+	// market, IsPlayable and LinkedFrom only when it is fetched with one.
+	AvailableMarkets []string `json:"available_markets"`
+	IsPlayable       *bool    `json:"is_playable"`
+	LinkedFrom       *struct {
+		ID string `json:"id"`
+	} `json:"linked_from"`
+	Restrictions *spotifyRestrictions `json:"restrictions"`
 }
 
-func handleArtistShort(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Missing query parameter 'q'", http.StatusBadRequest)
-		return
-	}
+type spotifyRestrictions struct {
+	Reason string `json:"reason"`
+}
 
-	client := NewSpotifyClient(clientID, clientSecret)
-	
-	// Search for artist
-	data, err := client.makeRequest("GET", "/search?q="+url.QueryEscape(query)+"&type=artist&limit=1")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyAlbum struct {
+	ID           string                `json:"id"`
+	Name         string                `json:"name"`
+	AlbumType    string                `json:"album_type"`
+	AlbumGroup   string                `json:"album_group"`
+	Artists      []spotifySimpleArtist `json:"artists"`
+	ReleaseDate  string                `json:"release_date"`
+	TotalTracks  int                   `json:"total_tracks"`
+	Popularity   int                   `json:"popularity"`
+	Genres       []string              `json:"genres"`
+	Images       []spotifyImage        `json:"images"`
+	ExternalURLs spotifyExternalURLs   `json:"external_urls"`
+	ExternalIDs  map[string]string     `json:"external_ids"`
+	Tracks       spotifyTrackPage      `json:"tracks"`
+	Restrictions *spotifyRestrictions  `json:"restrictions"`
+}
 
-	var searchResult map[string]interface{}
-	if err := json.Unmarshal(data, &searchResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyUser struct {
+	ID           string              `json:"id"`
+	DisplayName  string              `json:"display_name"`
+	ExternalURLs spotifyExternalURLs `json:"external_urls"`
+	Images       []spotifyImage      `json:"images"`
+	Followers    struct {
+		Total int `json:"total"`
+	} `json:"followers"`
+}
 
-	artists := searchResult["artists"].(map[string]interface{})
-	items := artists["items"].([]interface{})
-	if len(items) == 0 {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "No artist found",
-		})
-		return
-	}
+type spotifyPlaylist struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Description  string              `json:"description"`
+	Public       bool                `json:"public"`
+	Owner        spotifyUser         `json:"owner"`
+	ExternalURLs spotifyExternalURLs `json:"external_urls"`
+	Images       []spotifyImage      `json:"images"`
+	Tracks       spotifyPageInfo     `json:"tracks"`
+	Followers    *struct {
+		Total int `json:"total"`
+	} `json:"followers"`
+}
 
-	artist := items[0].(map[string]interface{})
-	
-	albumsData, err := client.makeRequest("GET", "/artists/"+artist["id"].(string)+"/albums")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyContext struct {
+	Type         string              `json:"type"`
+	URI          string              `json:"uri"`
+	Href         string              `json:"href"`
+	ExternalURLs spotifyExternalURLs `json:"external_urls"`
+}
 
-	var albumsResult map[string]interface{}
-	if err := json.Unmarshal(albumsData, &albumsResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyCurrentlyPlaying struct {
+	IsPlaying bool            `json:"is_playing"`
+	Item      *spotifyTrack   `json:"item"`
+	Context   *spotifyContext `json:"context"`
+}
 
-	var albums, singles, compilations int
-	for _, item := range albumsResult["items"].([]interface{}) {
-		albumType := item.(map[string]interface{})["album_type"].(string)
-		switch albumType {
-		case "album":
-			albums++
-		case "single":
-			singles++
-		case "compilation":
-			compilations++
-		}
-	}
+type spotifyQueue struct {
+	CurrentlyPlaying *spotifyTrack  `json:"currently_playing"`
+	Queue            []spotifyTrack `json:"queue"`
+}
 
-	response := ArtistShortResponse{
-		Success: true,
-		Artist: ArtistInfo{
-			Name:       artist["name"].(string),
-			ID:         artist["id"].(string),
-			URL:        artist["external_urls"].(map[string]interface{})["spotify"].(string),
-			Image:      getArtistImage(artist),
-			Genres:     getStringSlice(artist["genres"].([]interface{})),
-			Followers:  int(artist["followers"].(map[string]interface{})["total"].(float64)),
-			Popularity: int(artist["popularity"].(float64)),
-			Albums:     albums,
-			Singles:    singles,
-			Compilations: compilations,
-		},
-	}
+type spotifyDevice struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	IsActive      bool   `json:"is_active"`
+	VolumePercent *int   `json:"volume_percent"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+type spotifyEpisode struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Description  string              `json:"description"`
+	ReleaseDate  string              `json:"release_date"`
+	DurationMs   int                 `json:"duration_ms"`
+	Explicit     bool                `json:"explicit"`
+	Images       []spotifyImage      `json:"images"`
+	ExternalURLs spotifyExternalURLs `json:"external_urls"`
+	Show         struct {
+		Name string `json:"name"`
+	} `json:"show"`
 }
 
-func handleArtistFull(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Missing query parameter 'q'", http.StatusBadRequest)
-		return
-	}
+type spotifyShow struct {
+	ID            string              `json:"id"`
+	Name          string              `json:"name"`
+	Publisher     string              `json:"publisher"`
+	Description   string              `json:"description"`
+	TotalEpisodes int                 `json:"total_episodes"`
+	Explicit      bool                `json:"explicit"`
+	Languages     []string            `json:"languages"`
+	Images        []spotifyImage      `json:"images"`
+	ExternalURLs  spotifyExternalURLs `json:"external_urls"`
+}
 
-	client := NewSpotifyClient(clientID, clientSecret)
-	
-	data, err := client.makeRequest("GET", "/search?q="+url.QueryEscape(query)+"&type=artist&limit=1")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// spotifyAudioFeatures holds a track's audio features. The float features
+// range from 0 to 1, except Loudness (in dB) and Tempo (in BPM).
+type spotifyAudioFeatures struct {
+	Acousticness     float64 `json:"acousticness"`
+	Danceability     float64 `json:"danceability"`
+	Energy           float64 `json:"energy"`
+	Valence          float64 `json:"valence"`
+	Tempo            float64 `json:"tempo"`
+	Instrumentalness float64 `json:"instrumentalness"`
+	Liveness         float64 `json:"liveness"`
+	Speechiness      float64 `json:"speechiness"`
+	Loudness         float64 `json:"loudness"`
+	Key              int     `json:"key"`
+	Mode             int     `json:"mode"`
+	TimeSignature    int     `json:"time_signature"`
+}
 
-	var searchResult map[string]interface{}
-	if err := json.Unmarshal(data, &searchResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// spotifyPlaylistItem is an entry of a playlist. Track is null for items
+// that are no longer available.
+type spotifyPlaylistItem struct {
+	Track   *spotifyTrack `json:"track"`
+	IsLocal bool          `json:"is_local"`
+}
 
-	artists := searchResult["artists"].(map[string]interface{})
-	items := artists["items"].([]interface{})
-	if len(items) == 0 {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "No artist found",
-		})
-		return
-	}
+type spotifyPlaylistItemPage struct {
+	spotifyPageInfo
+	Items []spotifyPlaylistItem `json:"items"`
+}
 
-	artist := items[0].(map[string]interface{})
-	artistID := artist["id"].(string)
+// spotifyPageInfo holds the fields shared by all of Spotify's paging objects.
+type spotifyPageInfo struct {
+	Total    int    `json:"total"`
+	Next     string `json:"next"`
+	Previous string `json:"previous"`
+}
 
-	tracksData, err := client.makeRequest("GET", "/artists/"+artistID+"/top-tracks?market=US")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyTrackPage struct {
+	spotifyPageInfo
+	Items []spotifyTrack `json:"items"`
+}
 
-	var tracksResult map[string]interface{}
-	if err := json.Unmarshal(tracksData, &tracksResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyChapter struct {
+	ID              string              `json:"id"`
+	Name            string              `json:"name"`
+	ChapterNumber   int                 `json:"chapter_number"`
+	DurationMs      int                 `json:"duration_ms"`
+	AudioPreviewURL string              `json:"audio_preview_url"`
+	Explicit        bool                `json:"explicit"`
+	ReleaseDate     string              `json:"release_date"`
+	Images          []spotifyImage      `json:"images"`
+	ExternalURLs    spotifyExternalURLs `json:"external_urls"`
+}
 
-	albumsData, err := client.makeRequest("GET", "/artists/"+artistID+"/albums")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyChapterPage struct {
+	spotifyPageInfo
+	Items []spotifyChapter `json:"items"`
+}
 
-	var albumsResult map[string]interface{}
-	if err := json.Unmarshal(albumsData, &albumsResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+type spotifyAlbumPage struct {
+	spotifyPageInfo
+	Items []spotifyAlbum `json:"items"`
+}
 
-	response := ArtistFullResponse{
-		Success: true,
-		Artist: ArtistFullInfo{
-			Name:      artist["name"].(string),
-			TopTracks: getTopTracks(tracksResult["tracks"].([]interface{})),
-			Albums:    getAlbums(albumsResult["items"].([]interface{})),
-			AlbumStats: getAlbumStats(albumsResult["items"].([]interface{})),
-		},
-	}
+// ValidationError describes a single invalid request parameter.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+type ValidationErrorResponse struct {
+	Success bool              `json:"success"`
+	Message string            `json:"message"`
+	Details []ValidationError `json:"details"`
+}
+
+// RankedSearchResponse is returned by /spotify/search/ranked: results of
+// several types in one list, most popular first.
+type RankedSearchResponse struct {
+	Success bool           `json:"success"`
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+}
+
+// FieldSearchResponse is returned by /spotify/search/fields. Query is the
+// Spotify search query built from the parameters.
+type FieldSearchResponse struct {
+	Success bool           `json:"success"`
+	Query   string         `json:"query"`
+	Type    string         `json:"type"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+type SearchResult struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Subtitle   string `json:"subtitle"`
+	Image      string `json:"image"`
+	Popularity int    `json:"popularity"`
+}
+
+// PlaylistDiffResponse compares the tracks of playlists A and B. Each track
+// is listed once, with how many times it occurs in each playlist.
+type PlaylistDiffResponse struct {
+	Success bool                `json:"success"`
+	A       string              `json:"a"`
+	B       string              `json:"b"`
+	OnlyInA []PlaylistDiffTrack `json:"only_in_a"`
+	OnlyInB []PlaylistDiffTrack `json:"only_in_b"`
+	Common  []PlaylistDiffTrack `json:"common"`
+}
+
+type PlaylistDiffTrack struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Artists string `json:"artists"`
+	URL     string `json:"url"`
+	CountA  int    `json:"count_a"`
+	CountB  int    `json:"count_b"`
+}
+
+// DuplicatesResponse lists the tracks that occur more than once in a
+// playlist. Positions are zero-based, as used by Spotify's playlist API.
+type DuplicatesResponse struct {
+	Success  bool             `json:"success"`
+	Playlist string           `json:"playlist"`
+	By       string           `json:"by"`
+	Groups   []DuplicateGroup `json:"groups"`
+}
+
+// MergeResponse is returned by /spotify/playlists/merge. Playlists holds the
+// names of the playlists read, in the order given, with "" for any that
+// failed; Skipped counts the local and unavailable tracks left out.
+type MergeResponse struct {
+	Success   bool         `json:"success"`
+	Playlists []string     `json:"playlists"`
+	By        string       `json:"by"`
+	Tracks    []TrackBasic `json:"tracks"`
+	Skipped   int          `json:"skipped"`
+	Partial   bool         `json:"partial,omitempty"`
+	Warnings  []string     `json:"warnings,omitempty"`
+	Complete  *bool        `json:"complete,omitempty"`
+}
+
+// DuplicateGroup is one set of duplicates. Key is the shared track id or
+// ISRC; IDs holds the distinct track ids, which differ when the same
+// recording appears on several releases.
+type DuplicateGroup struct {
+	Key       string   `json:"key"`
+	Name      string   `json:"name"`
+	Artists   string   `json:"artists"`
+	IDs       []string `json:"ids"`
+	Positions []int    `json:"positions"`
+}
+
+// PageResponse is returned by /spotify/page when following a paging URL.
+type PageResponse struct {
+	Success  bool        `json:"success"`
+	Type     string      `json:"type"`
+	Items    interface{} `json:"items"`
+	Total    int         `json:"total"`
+	Next     string      `json:"next,omitempty"`
+	Previous string      `json:"previous,omitempty"`
+}
+
+type SpotifyClient struct {
+	ClientID     string
+	ClientSecret string
+	AccessToken  string
+	TokenType    string
+	ExpiresAt    time.Time
+	HTTPClient   *http.Client
+
+	// RefreshToken and Scope are only set for clients acting on behalf of a
+	// logged-in user; see userClient.
+	RefreshToken string
+	Scope        string
+	sessionID    string
+
+	// MaxRetries is how many times a rate-limited (429), failed (5xx) or
+	// network-errored request is retried. Each wait is capped at MaxRetryWait.
+	MaxRetries   int
+	MaxRetryWait time.Duration
+
+	// AuthRetries and AuthTimeout apply to token requests instead of
+	// MaxRetries and the HTTP client's timeout. Every data call waits on
+	// the token, so they are retried harder, with waits of at most
+	// maxAuthRetryWait.
+	AuthRetries int
+	AuthTimeout time.Duration
+
+	// Cache, if set, holds GET responses for CacheTTL. Only the shared
+	// catalog client has one; user data is never cached.
+	Cache    Cache
+	CacheTTL time.Duration
+
+	// StaleTimeout, if set, is how long a stale cache entry waits for
+	// revalidation before it is served as is; see get.
+	StaleTimeout time.Duration
+
+	revalidateMu  sync.Mutex // guards revalidations
+	revalidations map[string]*revalidation
+
+	// Breaker, if set, stops calls to Spotify while it is failing. It is
+	// shared by all clients.
+	Breaker *circuitBreaker
+
+	// Credentials, if set, replaces ClientID and ClientSecret for app
+	// tokens with a pool of app credentials that requests rotate across.
+	// ClientID and ClientSecret are still used to log users in.
+	Credentials *credentialPool
+
+	mu         sync.Mutex // guards the token fields above and refreshing
+	refreshing *tokenRefresh
+}
+
+// APIError is returned when Spotify responds with a non-2xx status.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("spotify api error (%d): %s", e.Status, e.Message)
+}
+
+// Timeouts for calls to Spotify. The overall requestTimeout is generous so
+// large responses can finish downloading; stalled connections are caught
+// by the shorter per-phase timeouts instead.
+var (
+	dialTimeout           = 5 * time.Second
+	tlsHandshakeTimeout   = 5 * time.Second
+	responseHeaderTimeout = 10 * time.Second
+	requestTimeout        = 60 * time.Second
+	authTimeout           = 15 * time.Second
+	// prefetchTimeout bounds a background prefetch, retries included, so
+	// that a slow page can't hold its prefetch slot indefinitely.
+	prefetchTimeout = 30 * time.Second
+)
+
+func NewSpotifyClient(clientID, clientSecret string) *SpotifyClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+
+	return &SpotifyClient{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		HTTPClient: &http.Client{
+			Timeout:       requestTimeout,
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
+		},
+		MaxRetries:   3,
+		MaxRetryWait: 30 * time.Second,
+		AuthRetries:  5,
+		AuthTimeout:  authTimeout,
+	}
+}
+
+// spotifyHosts are the only hosts the service will talk to, both for
+// user-supplied URLs and for redirects followed by the HTTP client.
+var spotifyHosts = map[string]bool{
+	"api.spotify.com":      true,
+	"open.spotify.com":     true,
+	"accounts.spotify.com": true,
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != "https" || !spotifyHosts[req.URL.Hostname()] {
+		return fmt.Errorf("refusing to follow redirect to %s", req.URL.Host)
+	}
+	return nil
+}
+
+// validateSpotifyURL parses a user-supplied URL and checks that it uses
+// HTTPS and points at one of the given hosts.
+func validateSpotifyURL(rawURL string, hosts ...string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("url is not a valid URL")
+	}
+	if u.Scheme != "https" || u.User != nil || u.Port() != "" {
+		return nil, fmt.Errorf("url must be an https URL without credentials or port")
+	}
+	for _, host := range hosts {
+		if u.Host == host {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("url must point to %s", strings.Join(hosts, " or "))
+}
+
+// authenticate fetches a new app token. c.mu must not be held; it is only
+// taken to store the token.
+func (c *SpotifyClient) authenticate(ctx context.Context) error {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+
+	tokenResp, err := c.requestToken(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.AccessToken = tokenResp.AccessToken
+	c.TokenType = tokenResp.TokenType
+	c.ExpiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+
+	return nil
+}
+
+// checkCredentials authenticates once with the app's client credentials and
+// prints the token it got, for -check-auth. App tokens carry no user scopes.
+// With a credential pool every pair is checked.
+func checkCredentials(c *SpotifyClient) error {
+	if c.Credentials != nil {
+		if err := c.Credentials.authenticateAll(context.Background(), c); err != nil {
+			return err
+		}
+		for _, cred := range c.Credentials.creds {
+			fmt.Printf("Credentials OK for client %s: %s token, scope: none (client credentials), expires %s (in %v)\n",
+				cred.clientID, cred.tokenType, cred.expiresAt.Format(time.RFC3339), time.Until(cred.expiresAt).Round(time.Second))
+		}
+		return nil
+	}
+	if err := c.authenticate(context.Background()); err != nil {
+		return err
+	}
+	fmt.Printf("Credentials OK: %s token, scope: none (client credentials), expires %s (in %v)\n",
+		c.TokenType, c.ExpiresAt.Format(time.RFC3339), time.Until(c.ExpiresAt).Round(time.Second))
+	return nil
+}
+
+// requestToken posts a grant to Spotify's token endpoint using the app's
+// client credentials.
+func (c *SpotifyClient) requestToken(ctx context.Context, data url.Values) (*TokenResponse, error) {
+	return c.requestTokenFor(ctx, c.ClientID, c.ClientSecret, data)
+}
+
+// AuthError is returned when no token could be obtained from Spotify's
+// accounts service. Status is 0 when Spotify couldn't be reached.
+type AuthError struct {
+	Status   int
+	Message  string
+	Attempts int
+}
+
+func (e *AuthError) Error() string {
+	msg := "spotify authentication failed"
+	if e.Status != 0 {
+		msg += fmt.Sprintf(" (%d)", e.Status)
+	}
+	msg += ": " + e.Message
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" (after %d attempts)", e.Attempts)
+	}
+	return msg
+}
+
+// transient reports whether a later attempt may succeed: rejected
+// credentials or grants won't, while rate limits, server errors and network
+// failures may.
+func (e *AuthError) transient() bool {
+	return e.Status == 0 || e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// maxAuthRetryWait caps each wait between token request attempts.
+const maxAuthRetryWait = 5 * time.Second
+
+// requestTokenFor is requestToken for the given app credentials. Transient
+// failures are retried up to AuthRetries times, or until ctx is done.
+func (c *SpotifyClient) requestTokenFor(ctx context.Context, clientID, clientSecret string, data url.Values) (*TokenResponse, error) {
+	for attempt := 0; ; attempt++ {
+		tokenResp, retryAfter, err := c.requestTokenOnce(ctx, clientID, clientSecret, data)
+		if err == nil {
+			return tokenResp, nil
+		}
+		if !err.transient() || attempt >= c.AuthRetries || ctx.Err() != nil {
+			err.Attempts = attempt + 1
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			err.Attempts = attempt + 1
+			return nil, err
+		case <-time.After(jitteredBackoff(attempt, retryAfter, maxAuthRetryWait)):
+		}
+	}
+}
+
+// requestTokenOnce makes a single token request. For 429 responses it also
+// returns the wait requested by Spotify's Retry-After header.
+func (c *SpotifyClient) requestTokenOnce(ctx context.Context, clientID, clientSecret string, data url.Values) (*TokenResponse, time.Duration, *AuthError) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://accounts.spotify.com/api/token", strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, 0, &AuthError{Message: err.Error()}
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
+	req.Header.Set("Authorization", "Basic "+auth)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// The copy shares the transport but has its own timeout.
+	client := *c.HTTPClient
+	client.Timeout = c.AuthTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, &AuthError{Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, &AuthError{Message: err.Error()}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var authErr struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		decodeJSON(body, &authErr)
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, retryAfter, &AuthError{
+			Status:  resp.StatusCode,
+			Message: strings.TrimSpace(authErr.Error + " " + authErr.ErrorDescription),
+		}
+	}
+
+	var tokenResp TokenResponse
+	if err := decodeJSON(body, &tokenResp); err != nil {
+		return nil, 0, &AuthError{Status: resp.StatusCode, Message: err.Error()}
+	}
+	return &tokenResp, 0, nil
+}
+
+// refreshUserToken exchanges the client's refresh token for a new access
+// token and saves it back to the user's session. c.mu must not be held.
+func (c *SpotifyClient) refreshUserToken(ctx context.Context) error {
+	c.mu.Lock()
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", c.RefreshToken)
+	c.mu.Unlock()
+
+	tokenResp, err := c.requestToken(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.AccessToken = tokenResp.AccessToken
+	c.TokenType = tokenResp.TokenType
+	c.ExpiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	// Spotify only sometimes rotates the refresh token.
+	if tokenResp.RefreshToken != "" {
+		c.RefreshToken = tokenResp.RefreshToken
+	}
+	if tokenResp.Scope != "" {
+		c.Scope = tokenResp.Scope
+	}
+	saved := UserToken{
+		AccessToken:  c.AccessToken,
+		RefreshToken: c.RefreshToken,
+		Scope:        c.Scope,
+		ExpiresAt:    c.ExpiresAt,
+	}
+	c.mu.Unlock()
+
+	return tokens.Set(c.sessionID, saved)
+}
+
+// tokenRefresh is a token request in flight. err is set before done is
+// closed.
+type tokenRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// refreshOnce returns the refresh in flight in *slot, starting one that
+// calls renew if there is none, so concurrent callers share one token
+// request. mu guards *slot and must be held; the refresh clears *slot under
+// it when it finishes. The refresh is detached from the callers' contexts,
+// so one caller giving up doesn't fail it for the others.
+func refreshOnce(mu *sync.Mutex, slot **tokenRefresh, renew func(ctx context.Context) error) *tokenRefresh {
+	if *slot != nil {
+		return *slot
+	}
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	*slot = refresh
+	go func() {
+		refresh.err = renew(context.Background())
+		mu.Lock()
+		*slot = nil
+		mu.Unlock()
+		close(refresh.done)
+	}()
+	return refresh
+}
+
+// wait waits for the refresh to finish, or for ctx to be done.
+func (r *tokenRefresh) wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// validToken returns the current access token, authenticating first if there
+// is none or it has expired. It is safe for concurrent use: c.mu is not held
+// while Spotify is asked for a token, and callers arriving meanwhile wait for
+// the same request until ctx is done.
+func (c *SpotifyClient) validToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	if c.AccessToken != "" && !time.Now().After(c.ExpiresAt) {
+		token := c.AccessToken
+		c.mu.Unlock()
+		return token, nil
+	}
+	renew := c.authenticate
+	if c.RefreshToken != "" {
+		renew = c.refreshUserToken
+	}
+	refresh := refreshOnce(&c.mu, &c.refreshing, renew)
+	c.mu.Unlock()
+
+	if err := refresh.wait(ctx); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.AccessToken, nil
+}
+
+// token returns the access token to use for the next call and, when it came
+// from c.Credentials, the credential it belongs to.
+func (c *SpotifyClient) token(ctx context.Context) (string, *poolCredential, error) {
+	if c.Credentials == nil {
+		token, err := c.validToken(ctx)
+		return token, nil, err
+	}
+	return c.Credentials.token(ctx, c)
+}
+
+// credentialPool rotates app tokens across several Spotify app credentials
+// to spread calls over their rate limits. Credentials are used round-robin,
+// skipping any that were rate limited until their Retry-After has passed;
+// when all are limited, the one that frees up soonest is used. Each keeps its
+// own token and expiry. It is safe for concurrent use.
+type credentialPool struct {
+	mu    sync.Mutex
+	creds []*poolCredential
+	next  int
+}
+
+type poolCredential struct {
+	clientID     string
+	clientSecret string
+	accessToken  string
+	tokenType    string
+	expiresAt    time.Time
+	limitedUntil time.Time
+	refreshing   *tokenRefresh
+}
+
+// parseCredentials parses a comma-separated list of CLIENT_ID:CLIENT_SECRET
+// pairs into a pool.
+func parseCredentials(raw string) (*credentialPool, error) {
+	pool := &credentialPool{}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not a CLIENT_ID:CLIENT_SECRET pair", pair)
+		}
+		pool.creds = append(pool.creds, &poolCredential{clientID: parts[0], clientSecret: parts[1]})
+	}
+	return pool, nil
+}
+
+// token picks the next credential and returns its token, authenticating it
+// first if it has none or it has expired. As in validToken, p.mu is not held
+// while authenticating and concurrent callers share the token request.
+func (p *credentialPool) token(ctx context.Context, c *SpotifyClient) (string, *poolCredential, error) {
+	p.mu.Lock()
+
+	now := time.Now()
+	var cred *poolCredential
+	for i := range p.creds {
+		if candidate := p.creds[(p.next+i)%len(p.creds)]; !now.Before(candidate.limitedUntil) {
+			cred = candidate
+			p.next = (p.next + i + 1) % len(p.creds)
+			break
+		}
+	}
+	if cred == nil {
+		cred = p.creds[0]
+		for _, candidate := range p.creds[1:] {
+			if candidate.limitedUntil.Before(cred.limitedUntil) {
+				cred = candidate
+			}
+		}
+	}
+
+	if cred.accessToken != "" && !now.After(cred.expiresAt) {
+		token := cred.accessToken
+		p.mu.Unlock()
+		return token, cred, nil
+	}
+	refresh := refreshOnce(&p.mu, &cred.refreshing, func(ctx context.Context) error {
+		return p.authenticate(ctx, c, cred)
+	})
+	p.mu.Unlock()
+
+	if err := refresh.wait(ctx); err != nil {
+		return "", nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return cred.accessToken, cred, nil
+}
+
+// authenticate fetches a new app token for cred. p.mu must not be held; it
+// is only taken to store the token.
+func (p *credentialPool) authenticate(ctx context.Context, c *SpotifyClient, cred *poolCredential) error {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+
+	tokenResp, err := c.requestTokenFor(ctx, cred.clientID, cred.clientSecret, data)
+	if err != nil {
+		return fmt.Errorf("client %s: %w", cred.clientID, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cred.accessToken = tokenResp.AccessToken
+	cred.tokenType = tokenResp.TokenType
+	cred.expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	return nil
+}
+
+// authenticateAll fetches a token for every credential, failing on the first
+// that is rejected.
+func (p *credentialPool) authenticateAll(ctx context.Context, c *SpotifyClient) error {
+	for _, cred := range p.creds {
+		if err := p.authenticate(ctx, c, cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimited marks cred as rate limited for retryAfter, or a second when
+// Spotify didn't say.
+func (p *credentialPool) rateLimited(cred *poolCredential, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cred.limitedUntil = time.Now().Add(retryAfter)
+}
+
+// available reports whether some credential isn't rate limited.
+func (p *credentialPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, cred := range p.creds {
+		if !now.Before(cred.limitedUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// getJSON performs a GET request and decodes the response into v.
+func (c *SpotifyClient) getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	data, err := c.get(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(data, v)
+}
+
+// utf8BOM is the byte order mark some proxies prepend to response bodies.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// secretFields matches JSON string fields holding credentials, such as
+// "access_token", so their values can be redacted from logged bodies.
+var secretFields = regexp.MustCompile(`"([a-z_]*(token|secret)[a-z_]*)"\s*:\s*"[^"]*"`)
+
+// maxBodySnippet is how much of a body that fails to decode is quoted in
+// the error.
+const maxBodySnippet = 200
+
+// decodeJSON unmarshals a response body from Spotify into v. A leading
+// UTF-8 BOM is ignored; trailing whitespace already is by json.Unmarshal.
+// Decode errors quote the start of the body, with credentials redacted, so
+// unexpected responses such as proxy error pages can be told apart.
+func decodeJSON(data []byte, v interface{}) error {
+	data = bytes.TrimPrefix(data, utf8BOM)
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	snippet := secretFields.ReplaceAll(data, []byte(`"$1":"[REDACTED]"`))
+	if len(snippet) > maxBodySnippet {
+		snippet = snippet[:maxBodySnippet]
+	}
+	return fmt.Errorf("decoding Spotify response: %w (body starts %q)", err, snippet)
+}
+
+// get is shorthand for a GET request without a body or extra headers.
+// Responses are served from and stored in c.Cache when there is one, and
+// the request is marked as served from the cache when they are reused.
+// Entries are kept for twice CacheTTL; in the second half they are
+// revalidated with their ETag, so unchanged responses aren't downloaded
+// again. If revalidation takes longer than StaleTimeout the stale entry is
+// returned instead, the request is marked as served stale, and the call
+// carries on in the background to refresh the cache. Requests finding the
+// same stale entry meanwhile share that one call.
+func (c *SpotifyClient) get(ctx context.Context, endpoint string) ([]byte, error) {
+	if c.Cache == nil {
+		return c.makeRequest(ctx, "GET", endpoint, nil, nil)
+	}
+
+	cached, ok := c.Cache.Get(endpoint)
+	if ok && time.Now().Before(cached.FreshUntil) {
+		markServedFromCache(ctx)
+		return cached.Data, nil
+	}
+	if !ok || c.StaleTimeout <= 0 {
+		return c.fetchAndCache(ctx, endpoint, cached, ok)
+	}
+
+	refresh := c.revalidate(endpoint, cached)
+	select {
+	case <-refresh.done:
+		return refresh.data, refresh.err
+	case <-time.After(c.StaleTimeout):
+		markServedStale(ctx)
+		return cached.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// revalidation is an in-flight refresh of a stale cache entry, shared by the
+// requests that find the entry stale while it runs.
+type revalidation struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// revalidate returns the in-flight refresh of endpoint's stale entry cached,
+// starting one if there is none. The refresh is detached from any request so
+// it outlives those answered from the stale entry.
+func (c *SpotifyClient) revalidate(endpoint string, cached cachedResponse) *revalidation {
+	c.revalidateMu.Lock()
+	defer c.revalidateMu.Unlock()
+	if pending, ok := c.revalidations[endpoint]; ok {
+		return pending
+	}
+	if c.revalidations == nil {
+		c.revalidations = make(map[string]*revalidation)
+	}
+	pending := &revalidation{done: make(chan struct{})}
+	c.revalidations[endpoint] = pending
+	go func() {
+		pending.data, pending.err = c.fetchAndCache(context.Background(), endpoint, cached, true)
+		c.revalidateMu.Lock()
+		delete(c.revalidations, endpoint)
+		c.revalidateMu.Unlock()
+		close(pending.done)
+	}()
+	return pending
+}
+
+// fetchAndCache fetches endpoint and stores it in c.Cache, revalidating cached
+// when ok.
+func (c *SpotifyClient) fetchAndCache(ctx context.Context, endpoint string, cached cachedResponse, ok bool) ([]byte, error) {
+	var headers http.Header
+	if ok && cached.ETag != "" {
+		headers = http.Header{"If-None-Match": {cached.ETag}}
+	}
+
+	data, respHeader, err := c.request(ctx, "GET", endpoint, nil, headers)
+	if apiErr, isAPIErr := err.(*APIError); isAPIErr {
+		switch {
+		case apiErr.Status == http.StatusNotModified && ok:
+			data, err = cached.Data, nil
+			respHeader = http.Header{}
+			respHeader.Set("ETag", cached.ETag)
+		case apiErr.Status == http.StatusNotFound:
+			c.Cache.Delete(endpoint)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Cache.Set(endpoint, cachedResponse{
+		Data:       data,
+		ETag:       respHeader.Get("ETag"),
+		FreshUntil: time.Now().Add(c.CacheTTL),
+	}, 2*c.CacheTTL)
+	return data, nil
+}
+
+// Cache stores Spotify responses by endpoint. Implementations must be safe
+// for concurrent use.
+type Cache interface {
+	Get(key string) (cachedResponse, bool)
+	Set(key string, resp cachedResponse, ttl time.Duration)
+	Delete(key string)
+}
+
+// cachedResponse is a response body with the ETag Spotify sent for it.
+type cachedResponse struct {
+	Data       []byte    `json:"data"`
+	ETag       string    `json:"etag,omitempty"`
+	FreshUntil time.Time `json:"freshUntil"`
+}
+
+// responseCache is the in-memory Cache. It holds at most maxSize bytes of
+// response bodies, evicting the least recently used entries to stay within
+// budget.
+type responseCache struct {
+	maxSize int
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // of *cacheEntry, most recently used first
+	size      int
+	hits      int
+	misses    int
+	evictions int
+}
+
+type cacheEntry struct {
+	key     string
+	resp    cachedResponse
+	expires time.Time
+}
+
+// CacheStats is returned by GET /admin/cache.
+type CacheStats struct {
+	Success   bool `json:"success"`
+	Entries   int  `json:"entries"`
+	Size      int  `json:"size"`
+	MaxSize   int  `json:"maxSize"`
+	Hits      int  `json:"hits"`
+	Misses    int  `json:"misses"`
+	Evictions int  `json:"evictions"`
+}
+
+func newResponseCache(maxSize int) *responseCache {
+	return &responseCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *responseCache) Get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && time.Now().After(elem.Value.(*cacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return cachedResponse{}, false
+	}
+	c.hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).resp, true
+}
+
+func (c *responseCache) Set(key string, resp cachedResponse, ttl time.Duration) {
+	if len(resp.Data) > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, resp: resp, expires: time.Now().Add(ttl)})
+	c.size += len(resp.Data)
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *responseCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove deletes elem. c.mu must be held.
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.resp.Data)
+}
+
+// flush removes every entry. Hit, miss and eviction counts are kept.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+}
+
+func (c *responseCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Success:   true,
+		Entries:   len(c.entries),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// redisCache is a Cache shared by every instance using the same Redis
+// server. Entries are stored as JSON.
+type redisCache struct {
+	client *redisClient
+}
+
+func redisCacheKey(key string) string {
+	return "spotify:cache:" + key
+}
+
+func (c *redisCache) get(key string) (cachedResponse, bool, error) {
+	reply, err := c.client.do("GET", redisCacheKey(key))
+	if err != nil {
+		return cachedResponse{}, false, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return cachedResponse{}, false, nil
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return cachedResponse{}, false, nil
+	}
+	return resp, true, nil
+}
+
+func (c *redisCache) set(key string, resp cachedResponse, ttl time.Duration) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.do("SET", redisCacheKey(key), string(data), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+func (c *redisCache) delete(key string) error {
+	_, err := c.client.do("DEL", redisCacheKey(key))
+	return err
+}
+
+// fallbackCache uses Redis, switching to an in-memory cache for as long as
+// Redis fails. Changes between the two are logged.
+type fallbackCache struct {
+	redis    *redisCache
+	fallback *responseCache
+
+	mu       sync.Mutex
+	degraded bool
+}
+
+// check records whether the last Redis call failed and reports whether it
+// did.
+func (c *fallbackCache) check(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if (err != nil) != c.degraded {
+		c.degraded = err != nil
+		if c.degraded {
+			fmt.Printf("Warning: shared cache unavailable, using in-memory cache: %v\n", err)
+		} else {
+			fmt.Println("Shared cache recovered")
+		}
+	}
+	return err != nil
+}
+
+func (c *fallbackCache) Get(key string) (cachedResponse, bool) {
+	resp, ok, err := c.redis.get(key)
+	if c.check(err) {
+		return c.fallback.Get(key)
+	}
+	return resp, ok
+}
+
+func (c *fallbackCache) Set(key string, resp cachedResponse, ttl time.Duration) {
+	if c.check(c.redis.set(key, resp, ttl)) {
+		c.fallback.Set(key, resp, ttl)
+	}
+}
+
+func (c *fallbackCache) Delete(key string) {
+	c.check(c.redis.delete(key))
+	c.fallback.Delete(key)
+}
+
+// makeRequest calls the Web API. body and headers may be nil. Authorization
+// is always set from the client's token, and Content-Type defaults to
+// application/json when a body is sent. The response body is returned for
+// 2xx responses and an *APIError for anything else.
+func (c *SpotifyClient) makeRequest(ctx context.Context, method, endpoint string, body io.Reader, headers http.Header) ([]byte, error) {
+	data, _, err := c.request(ctx, method, endpoint, body, headers)
+	return data, err
+}
+
+// request is makeRequest that also returns the response headers.
+func (c *SpotifyClient) request(ctx context.Context, method, endpoint string, body io.Reader, headers http.Header) ([]byte, http.Header, error) {
+	// Buffer the body so it can be replayed on retries.
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, cred, err := c.token(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !c.Breaker.allow() {
+			return nil, nil, errCircuitOpen
+		}
+		start := time.Now()
+		data, respHeader, retryAfter, err := c.doRequest(ctx, method, endpoint, token, payload, headers)
+		recordUpstreamCall(ctx, method+" "+endpoint, time.Since(start))
+		// A request cancelled by our own caller says nothing about Spotify.
+		if ctx.Err() != nil {
+			c.Breaker.abort()
+		} else {
+			c.Breaker.record(isUpstreamFailure(err))
+			upstreamResults.record(err)
+		}
+		if err == nil {
+			return data, respHeader, nil
+		}
+		if !isRetryable(err) || attempt >= c.MaxRetries {
+			return nil, nil, restrictedEndpointError(endpoint, err)
+		}
+		wait := c.backoff(attempt, retryAfter)
+		// A rate limit on one credential needn't hold up the others.
+		if apiErr, ok := err.(*APIError); ok && apiErr.Status == http.StatusTooManyRequests && cred != nil {
+			c.Credentials.rateLimited(cred, retryAfter)
+			if c.Credentials.available() {
+				wait = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doRequest performs a single API call, returning the response body and
+// headers. For 429 responses it also returns the wait requested by Spotify's
+// Retry-After header.
+func (c *SpotifyClient) doRequest(ctx context.Context, method, endpoint, token string, payload []byte, headers http.Header) ([]byte, http.Header, time.Duration, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.spotify.com/v1"+endpoint, reqBody)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for key, values := range headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if payload != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var retryAfter time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, nil, retryAfter, newAPIError(resp.StatusCode, body)
+	}
+
+	return body, resp.Header, 0, nil
+}
+
+// RestrictedEndpointError is returned when Spotify refuses one of the
+// endpoints it has restricted for apps without extended access, such as
+// audio features, recommendations and related artists.
+type RestrictedEndpointError struct {
+	Endpoint string
+	Message  string
+}
+
+func (e *RestrictedEndpointError) Error() string {
+	return fmt.Sprintf("this endpoint is restricted for your app: Spotify refused %s (%s); it is only available to apps with extended API access", e.Endpoint, e.Message)
+}
+
+// restrictedEndpoints matches the endpoints Spotify has restricted for new
+// and development-mode apps. It answers them with a bare 403.
+var restrictedEndpoints = regexp.MustCompile(`^/(audio-features|audio-analysis|recommendations)([/?]|$)|^/artists/[^/?]+/related-artists|^/browse/(featured-playlists|categories/[^/?]+/playlists)`)
+
+// restrictedEndpointError turns a 403 from a restricted endpoint into a
+// *RestrictedEndpointError and returns other errors unchanged.
+func restrictedEndpointError(endpoint string, err error) error {
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Status != http.StatusForbidden || !restrictedEndpoints.MatchString(endpoint) {
+		return err
+	}
+	return &RestrictedEndpointError{
+		Endpoint: strings.SplitN(endpoint, "?", 2)[0],
+		Message:  apiErr.Message,
+	}
+}
+
+func newAPIError(status int, body []byte) *APIError {
+	var errResp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	decodeJSON(body, &errResp)
+	message := errResp.Error.Message
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &APIError{Status: status, Message: message}
+}
+
+// isRetryable reports whether err is a rate limit, a server error or a
+// network failure, all of which may succeed on a later attempt.
+func isRetryable(err error) bool {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return true
+	}
+	return apiErr.Status == http.StatusTooManyRequests || apiErr.Status >= 500
+}
+
+// backoff returns how long to wait before the given retry attempt. It uses
+// retryAfter when Spotify sent one and exponential backoff otherwise, then
+// adds up to 50% random jitter so throttled clients don't all retry at the
+// same instant. The result never exceeds MaxRetryWait.
+func (c *SpotifyClient) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	return jitteredBackoff(attempt, retryAfter, c.MaxRetryWait)
+}
+
+// jitteredBackoff is backoff with the given cap.
+func jitteredBackoff(attempt int, retryAfter, max time.Duration) time.Duration {
+	wait := retryAfter
+	if wait <= 0 {
+		// Doubling stops once max is reached, long before it could overflow.
+		wait = retryBaseDelay
+		for i := 0; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+	}
+	wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+const retryBaseDelay = 500 * time.Millisecond
+
+// maxRetriesLimit bounds -max-retries and -auth-retries. With waits capped
+// by -max-retry-wait, more retries would only hold requests for minutes.
+const maxRetriesLimit = 20
+
+// isUpstreamFailure reports whether err means Spotify itself is unhealthy: a
+// server error or a network failure. Rate limits and other 4xx responses show
+// that Spotify is up.
+func isUpstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	apiErr, ok := err.(*APIError)
+	return !ok || apiErr.Status >= 500
+}
+
+var errCircuitOpen = errors.New("Spotify is unavailable; not retrying until the circuit breaker cools down")
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker fails calls fast once Spotify has failed threshold times in
+// a row. After cooldown it lets a single probe through (half-open): success
+// closes the breaker again and failure reopens it. A nil *circuitBreaker
+// allows everything.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+	opens    int
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may go ahead.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.opens++
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// abort releases an allowed call without recording an outcome, so a
+// cancelled probe doesn't leave the breaker half-open forever.
+func (b *circuitBreaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// snapshot returns the breaker state, consecutive failures and the number of
+// times the breaker has opened.
+func (b *circuitBreaker) snapshot() (state, failures, opens int) {
+	if b == nil {
+		return breakerClosed, 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.failures, b.opens
+}
+
+// adminKey enables the /admin/ endpoints when set. Requests must send it in
+// the X-Admin-Key header.
+var adminKey string
+
+// requireAdmin wraps next so that it only runs for requests carrying the
+// admin key.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Key")), []byte(adminKey)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, "Missing or invalid X-Admin-Key")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminCache reports cache statistics (GET) or flushes the cache
+// (DELETE).
+func handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	if spotifyClient.Cache == nil {
+		writeError(w, r, http.StatusNotFound, "Caching is disabled")
+		return
+	}
+	cache, ok := spotifyClient.Cache.(*responseCache)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, "Stats and flushing are only available for the in-memory cache")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, http.StatusOK, cache.stats())
+	case http.MethodDelete:
+		cache.flush()
+		writeJSON(w, r, http.StatusOK, cache.stats())
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use GET for cache stats or DELETE to flush the cache")
+	}
+}
+
+// CapabilitiesResponse is returned by /spotify/capabilities so clients can
+// detect which features this server offers and what Spotify can't provide.
+type CapabilitiesResponse struct {
+	Success     bool         `json:"success"`
+	Version     string       `json:"version"`
+	Features    []Capability `json:"features"`
+	Limitations []Limitation `json:"limitations"`
+}
+
+// Capability is a group of endpoints. Enabled is false for features the
+// server wasn't configured for. Restricted features rely on Spotify
+// endpoints that only apps with extended API access may call. Cost notes
+// any upstream calls a feature makes beyond what it returns.
+type Capability struct {
+	Name          string   `json:"name"`
+	Endpoints     []string `json:"endpoints"`
+	Enabled       bool     `json:"enabled"`
+	RequiresLogin bool     `json:"requiresLogin,omitempty"`
+	Restricted    bool     `json:"restricted,omitempty"`
+	Cost          string   `json:"cost,omitempty"`
+}
+
+// Limitation is something clients commonly ask for that Spotify's Web API
+// doesn't offer.
+type Limitation struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// limitations are the known gaps in Spotify's Web API.
+var limitations = []Limitation{
+	{"monthlyListeners", "Spotify's Web API doesn't expose an artist's monthly listeners, so artist responses never include them."},
+	{"playlistsContainingTrack", "There is no reverse lookup from a track to the playlists that contain it."},
+	{"playCounts", "Play counts of tracks and albums are not available."},
+	{"restrictedEndpoints", "Audio features and analysis, recommendations, related artists and browse playlists are only available to apps with extended API access. Features marked restricted answer 403 otherwise."},
+}
+
+// handleCapabilities lists the features this server offers and the known
+// limitations of Spotify's Web API.
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	features := []Capability{
+		{Name: "search", Endpoints: []string{"/spotify/songs", "/spotify/search/count", "/spotify/search/ranked", "/spotify/search/fields"}, Enabled: true},
+		{Name: "artists", Endpoints: []string{"/spotify/artist/short", "/spotify/artist/full", "/spotify/artist/stats", "/spotify/artist/appears-on", "/spotify/artist/track-count", "/spotify/artist/export", "/spotify/artist/latest", "/spotify/artist/genres", "/spotify/artists/top-tracks"}, Enabled: true},
+		{Name: "similarArtists", Endpoints: []string{"/spotify/artist/similar"}, Enabled: true, Restricted: true},
+		{Name: "albums", Endpoints: []string{"/spotify/album", "/spotify/album/upc", "/spotify/album/more", "/spotify/track/album"}, Enabled: true},
+		{Name: "tracks", Endpoints: []string{"/spotify/tracks", "/spotify/tracks/isrc", "/spotify/track/markets", "/spotify/track/artists"}, Enabled: true},
+		{Name: "similarTracks", Endpoints: []string{"/spotify/track/similar"}, Enabled: true, Restricted: true},
+		{Name: "podcasts", Endpoints: []string{"/spotify/episodes", "/spotify/shows", "/spotify/audiobook/chapters"}, Enabled: true},
+		{Name: "playlists", Endpoints: []string{"/spotify/playlist", "/spotify/playlist/image", "/spotify/playlists/diff", "/spotify/playlist/duplicates", "/spotify/playlists/merge"}, Enabled: true},
+		{Name: "users", Endpoints: []string{"/spotify/user"}, Enabled: true},
+		{Name: "links", Endpoints: []string{"/spotify/resolve", "/spotify/resolve/batch", "/spotify/normalize-ids", "/spotify/page"}, Enabled: true},
+		{Name: "prefetch", Endpoints: []string{"/spotify/artist/full", "/spotify/album", "/spotify/audiobook/chapters", "/spotify/page"}, Enabled: spotifyClient.Cache != nil, Cost: "prefetch=true makes one more Spotify call per response, counted against the app's rate limit even if the next page is never requested."},
+		{Name: "login", Endpoints: []string{"/spotify/login", "/spotify/callback"}, Enabled: true},
+		{Name: "library", Endpoints: []string{"/spotify/me/following", "/spotify/me/following/contains", "/spotify/me/albums", "/spotify/me/playlists", "/spotify/playlist/tracks"}, Enabled: true, RequiresLogin: true},
+		{Name: "recommendations", Endpoints: []string{"/spotify/me/recommendations"}, Enabled: true, RequiresLogin: true, Restricted: true},
+		{Name: "player", Endpoints: []string{"/spotify/me/player/context", "/spotify/me/player/queue", "/spotify/me/player/devices", "/spotify/me/player/play", "/spotify/me/player/pause", "/spotify/me/player/next", "/spotify/me/player/previous"}, Enabled: true, RequiresLogin: true},
+		{Name: "releaseWatches", Endpoints: []string{"/watch/artist"}, Enabled: webhookSecret != "" && adminKey != ""},
+		{Name: "cacheAdmin", Endpoints: []string{"/admin/cache"}, Enabled: adminKey != ""},
+		{Name: "metrics", Endpoints: []string{"/metrics"}, Enabled: true},
+	}
+
+	writeJSON(w, r, http.StatusOK, CapabilitiesResponse{
+		Success:     true,
+		Version:     version,
+		Features:    features,
+		Limitations: limitations,
+	})
+}
+
+// handleMetrics exposes service metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	state, failures, opens := spotifyClient.Breaker.snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP spotify_circuit_breaker_state Circuit breaker state: 0 closed, 1 open, 2 half-open.")
+	fmt.Fprintln(w, "# TYPE spotify_circuit_breaker_state gauge")
+	fmt.Fprintf(w, "spotify_circuit_breaker_state %d\n", state)
+	fmt.Fprintln(w, "# HELP spotify_circuit_breaker_failures Consecutive failed Spotify calls.")
+	fmt.Fprintln(w, "# TYPE spotify_circuit_breaker_failures gauge")
+	fmt.Fprintf(w, "spotify_circuit_breaker_failures %d\n", failures)
+	fmt.Fprintln(w, "# HELP spotify_circuit_breaker_opens_total Times the circuit breaker has opened.")
+	fmt.Fprintln(w, "# TYPE spotify_circuit_breaker_opens_total counter")
+	fmt.Fprintf(w, "spotify_circuit_breaker_opens_total %d\n", opens)
+
+	attempts, upstreamErrors := upstreamResults.snapshot()
+	fmt.Fprintln(w, "# HELP spotify_upstream_requests_total Spotify API attempts, retries included.")
+	fmt.Fprintln(w, "# TYPE spotify_upstream_requests_total counter")
+	fmt.Fprintf(w, "spotify_upstream_requests_total %d\n", attempts)
+	fmt.Fprintln(w, "# HELP spotify_upstream_errors_total Failed Spotify API attempts by status code, or network_error.")
+	fmt.Fprintln(w, "# TYPE spotify_upstream_errors_total counter")
+	for _, e := range upstreamErrors {
+		fmt.Fprintf(w, "spotify_upstream_errors_total{status=%q} %d\n", e.status, e.count)
+	}
+
+	fmt.Fprintln(w, "# HELP spotify_request_duration_seconds Latency of recent requests per endpoint.")
+	fmt.Fprintln(w, "# TYPE spotify_request_duration_seconds summary")
+	for _, l := range latencies.percentiles() {
+		fmt.Fprintf(w, "spotify_request_duration_seconds{endpoint=%q,quantile=\"0.5\"} %g\n", l.endpoint, l.p50.Seconds())
+		fmt.Fprintf(w, "spotify_request_duration_seconds{endpoint=%q,quantile=\"0.95\"} %g\n", l.endpoint, l.p95.Seconds())
+		fmt.Fprintf(w, "spotify_request_duration_seconds{endpoint=%q,quantile=\"0.99\"} %g\n", l.endpoint, l.p99.Seconds())
+		fmt.Fprintf(w, "spotify_request_duration_seconds_count{endpoint=%q} %d\n", l.endpoint, l.count)
+	}
+}
+
+func handleSpotifySongs(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.id(r, "track")
+	var query string
+	if id == "" {
+		query = v.searchText(r, "q")
+	}
+	features := v.boolean(r, "features", false)
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var track spotifyTrack
+	var err error
+	if id != "" {
+		err = getInMarket(r.Context(), client, "/tracks/"+url.PathEscape(id), market, &track)
+	} else {
+		err = searchFirst(r.Context(), client, query, "track", market, &track)
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := TrackResponse{
+		Success: true,
+		Track:   getTrackInfo(track),
+	}
+	if withAlbum {
+		response.Track.Album = getTrackAlbum(track.Album)
+	}
+	if query != "" {
+		response.MatchScore = matchScore(query, withArtists(track.Name, track.Artists)...)
+	}
+	if features && track.ID != "" {
+		var f spotifyAudioFeatures
+		if err := client.getJSON(r.Context(), "/audio-features/"+url.PathEscape(track.ID), &f); err != nil {
+			response.Partial = true
+			response.Warnings = []string{"features: " + err.Error()}
+		} else {
+			response.Features = getAudioFeatures(f)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleTrackAlbum returns a track and the other tracks on its album. The
+// track is given by id or found by q.
+func handleTrackAlbum(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.id(r, "track")
+	var query string
+	if id == "" {
+		query = v.searchText(r, "q")
+	}
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var track spotifyTrack
+	var err error
+	if id != "" {
+		err = getInMarket(r.Context(), client, "/tracks/"+url.PathEscape(id), market, &track)
+	} else {
+		err = searchFirst(r.Context(), client, query, "track", market, &track)
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	if track.Album == nil || track.Album.ID == "" {
+		writeNotFound(w, r, "No album found")
+		return
+	}
+
+	albumTracks, err := fetchAllAlbumTracks(r.Context(), client, track.Album.ID, market)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	basics := getTracks(albumTracks)
+	siblings := make([]AlbumSiblingTrack, len(albumTracks))
+	for i, t := range albumTracks {
+		siblings[i] = AlbumSiblingTrack{
+			TrackBasic: basics[i],
+			ID:         t.ID,
+			Current:    t.ID == track.ID,
+		}
+	}
+
+	response := TrackAlbumResponse{
+		Success: true,
+		Track:   getTrackInfo(track),
+		Album: ArtistBasic{
+			Name: track.Album.Name,
+			ID:   track.Album.ID,
+			URL:  track.Album.ExternalURLs.Spotify,
+		},
+		Tracks: siblings,
+	}
+	if query != "" {
+		response.MatchScore = matchScore(query, withArtists(track.Name, track.Artists)...)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// fetchAllAlbumTracks pages through all of an album's tracks.
+func fetchAllAlbumTracks(ctx context.Context, client *SpotifyClient, albumID, market string) ([]spotifyTrack, error) {
+	var tracks []spotifyTrack
+	endpoint := withMarket("/albums/"+url.PathEscape(albumID)+"/tracks?limit=50", market)
+	for endpoint != "" {
+		var page spotifyTrackPage
+		if err := client.getJSON(ctx, endpoint, &page); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, page.Items...)
+
+		endpoint = ""
+		if page.Next != "" {
+			var err error
+			if endpoint, err = pagingEndpoint(page.Next); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// handleTrackArtists returns a track with its album and all of its artists,
+// featured ones included, looked up in full. The track is given by id or
+// found by q. Artists credited on both the track and its album are looked
+// up once.
+func handleTrackArtists(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.id(r, "track")
+	var query string
+	if id == "" {
+		query = v.searchText(r, "q")
+	}
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var track spotifyTrack
+	var err error
+	if id != "" {
+		err = getInMarket(r.Context(), client, "/tracks/"+url.PathEscape(id), market, &track)
+	} else {
+		err = searchFirst(r.Context(), client, query, "track", market, &track)
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	credited := track.Artists
+	if track.Album != nil {
+		credited = append(append([]spotifySimpleArtist(nil), credited...), track.Album.Artists...)
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, artist := range credited {
+		if artist.ID != "" && !seen[artist.ID] {
+			seen[artist.ID] = true
+			ids = append(ids, artist.ID)
+		}
+	}
+
+	failures := &subCallFailures{}
+	full := fetchArtistsByID(r.Context(), client, ids, failures)
+	batches := (len(ids) + maxArtistsPerRequest - 1) / maxArtistsPerRequest
+	if batches > 0 && failures.all(batches) {
+		writeUpstreamError(w, r, failures.first)
+		return
+	}
+	byID := make(map[string]spotifyArtist, len(ids))
+	for _, artist := range full {
+		if artist != nil {
+			byID[artist.ID] = *artist
+		}
+	}
+
+	info := getTrackInfo(track)
+	info.Album = getTrackAlbum(track.Album)
+	response := TrackArtistsResponse{
+		Success:      true,
+		Track:        info,
+		Artists:      resolveArtists(track.Artists, byID),
+		AlbumArtists: []ArtistInfo{},
+		Partial:      len(failures.warnings) > 0,
+		Warnings:     failures.warnings,
+	}
+	if track.Album != nil {
+		response.AlbumArtists = resolveArtists(track.Album.Artists, byID)
+	}
+	if query != "" {
+		response.MatchScore = matchScore(query, withArtists(track.Name, track.Artists)...)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// resolveArtists returns the full artist for each of artists, in order,
+// leaving out those missing from byID.
+func resolveArtists(artists []spotifySimpleArtist, byID map[string]spotifyArtist) []ArtistInfo {
+	resolved := []ArtistInfo{}
+	for _, artist := range artists {
+		if full, ok := byID[artist.ID]; ok {
+			resolved = append(resolved, getArtistInfo(full, AlbumStats{}))
+		}
+	}
+	return resolved
+}
+
+// maxArtistsPerRequest is the most ids Spotify accepts in one /artists call.
+const maxArtistsPerRequest = 50
+
+// fetchArtistsByID looks up artists maxArtistsPerRequest at a time. The
+// result corresponds to ids index by index; artists that couldn't be fetched
+// are nil and their batch is recorded in failures.
+func fetchArtistsByID(ctx context.Context, client *SpotifyClient, ids []string, failures *subCallFailures) []*spotifyArtist {
+	full := make([]*spotifyArtist, len(ids))
+	var tasks []func(ctx context.Context) error
+	for start := 0; start < len(ids); start += maxArtistsPerRequest {
+		start := start
+		end := start + maxArtistsPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+		tasks = append(tasks, func(ctx context.Context) error {
+			var result struct {
+				Artists []*spotifyArtist `json:"artists"`
+			}
+			if err := client.getJSON(ctx, "/artists?ids="+strings.Join(ids[start:end], ","), &result); err != nil {
+				failures.add("artists", err)
+				return nil
+			}
+			for i, artist := range result.Artists {
+				if start+i < end {
+					full[start+i] = artist
+				}
+			}
+			return nil
+		})
+	}
+	runParallel(ctx, tasks...)
+	return full
+}
+
+// NotFoundError is returned by searchFirst when a search has no results.
+type NotFoundError struct {
+	SearchType string
+}
+
+func (e *NotFoundError) Error() string {
+	// Keep the messages the handlers have always returned.
+	if e.SearchType == "track" {
+		return "No tracks found"
+	}
+	return "No " + e.SearchType + " found"
+}
+
+// searchFirst decodes the first result of a search for a single type into v,
+// returning a *NotFoundError if there are none.
+func searchFirst(ctx context.Context, client *SpotifyClient, query, searchType, market string, v interface{}) error {
+	// Results are keyed by the plural of their type, e.g. "tracks".
+	var searchResult map[string]struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := client.getJSON(ctx, withMarket("/search?q="+url.QueryEscape(query)+"&type="+searchType+"&limit=1", market), &searchResult); err != nil {
+		return err
+	}
+
+	for _, item := range searchResult[searchType+"s"].Items {
+		// Spotify occasionally returns null entries in search results.
+		if string(item) != "null" {
+			return json.Unmarshal(item, v)
+		}
+	}
+	return &NotFoundError{SearchType: searchType}
+}
+
+// matchScore rates how closely a search result matches the query, from 0 to 1.
+// The query and each candidate name are lowercased and reduced to words of
+// letters and digits, then compared by Levenshtein distance normalised by the
+// longer of the two: 1 - distance/max(len(query), len(candidate)), counted in
+// runes. The best score over the candidates is returned, rounded to three
+// decimal places.
+func matchScore(query string, candidates ...string) *float64 {
+	q := []rune(normalizeForMatch(query))
+	best := 0.0
+	for _, candidate := range candidates {
+		c := []rune(normalizeForMatch(candidate))
+		longest := len(q)
+		if len(c) > longest {
+			longest = len(c)
+		}
+		score := 1.0
+		if longest > 0 {
+			score = 1 - float64(levenshtein(q, c))/float64(longest)
+		}
+		if score > best {
+			best = score
+		}
+	}
+	best = math.Round(best*1000) / 1000
+	return &best
+}
+
+// withArtists lists the ways a query may name a track or album: by its name
+// alone, or together with its artists before or after it.
+func withArtists(name string, artists []spotifySimpleArtist) []string {
+	if len(artists) == 0 {
+		return []string{name}
+	}
+	names := artistNames(artists)
+	return []string{name, name + " " + names, names + " " + name}
+}
+
+// normalizeForMatch lowercases s and replaces every run of characters other
+// than letters and digits with a single space.
+func normalizeForMatch(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// levenshtein returns the number of single-rune insertions, deletions and
+// substitutions needed to turn a into b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func handleArtistShort(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	offset := v.intRange(r, "offset", 0, 0, 10000)
+	color := v.boolean(r, "color", false)
+	noCompilations := v.boolean(r, "exclude_compilations", false)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	endpoint := albumsEndpoint(artist.ID, limit, offset)
+	if noCompilations {
+		endpoint += "&include_groups=" + nonCompilationGroups
+	}
+	var albums spotifyAlbumPage
+	if err := client.getJSON(r.Context(), withMarket(endpoint, market), &albums); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := ArtistShortResponse{
+		Success:    true,
+		Artist:     getArtistInfo(artist, getAlbumStats(albums.Items)),
+		MatchScore: matchScore(query, artist.Name),
+	}
+	if color {
+		response.Artist.Color = artistColor(r.Context(), client, artist)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+func handleArtistFull(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	offset := v.intRange(r, "offset", 0, 0, 10000)
+	color := v.boolean(r, "color", false)
+	noCompilations := v.boolean(r, "exclude_compilations", false)
+	prefetch := v.boolean(r, "prefetch", false)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Top tracks require a market, so fall back to US when none is given.
+	topMarket := market
+	if topMarket == "" {
+		topMarket = "US"
+	}
+	albumsPath := albumsEndpoint(artist.ID, limit, offset)
+	if noCompilations {
+		albumsPath += "&include_groups=" + nonCompilationGroups
+	}
+	// Top tracks and albums are independent, so fetch them concurrently.
+	var failures subCallFailures
+	var topTracks struct {
+		Tracks []spotifyTrack `json:"tracks"`
+	}
+	var albums spotifyAlbumPage
+	runParallel(r.Context(),
+		func(ctx context.Context) error {
+			if err := client.getJSON(ctx, withMarket("/artists/"+artist.ID+"/top-tracks", topMarket), &topTracks); err != nil {
+				failures.add("topTracks", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			if err := client.getJSON(ctx, withMarket(albumsPath, market), &albums); err != nil {
+				failures.add("albums", err)
+			}
+			return nil
+		},
+	)
+	if failures.all(2) {
+		writeUpstreamError(w, r, failures.first)
+		return
+	}
+
+	response := ArtistFullResponse{
+		Success: true,
+		Artist: ArtistFullInfo{
+			Name:       artist.Name,
+			TopTracks:  getTopTracks(topTracks.Tracks),
+			Albums:     getAlbums(albums.Items),
+			AlbumStats: getAlbumStats(albums.Items),
+			AlbumsNext: albums.Next,
+		},
+		MatchScore: matchScore(query, artist.Name),
+		Partial:    len(failures.warnings) > 0,
+		Warnings:   failures.warnings,
+	}
+	if color {
+		response.Artist.Color = artistColor(r.Context(), client, artist)
+	}
+	if prefetch {
+		prefetchPage(client, albums.Next)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
 }
 
 func handleAlbum(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		http.Error(w, "Missing query parameter 'q'", http.StatusBadRequest)
+	v := &validator{}
+	albumID := v.id(r, "album")
+	var query string
+	if albumID == "" {
+		query = v.searchText(r, "q")
+	}
+	bestEdition := v.boolean(r, "best_edition", false)
+	enrich := v.boolean(r, "enrich", false)
+	prefetch := v.boolean(r, "prefetch", false)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var score *float64
+	if albumID == "" {
+		var album spotifyAlbum
+		var err error
+		if bestEdition {
+			album, err = searchBestEdition(r.Context(), client, query, market)
+		} else {
+			err = searchFirst(r.Context(), client, query, "album", market, &album)
+		}
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		albumID = album.ID
+		score = matchScore(query, withArtists(album.Name, album.Artists)...)
+	}
+
+	var album spotifyAlbum
+	if err := getInMarket(r.Context(), client, "/albums/"+url.PathEscape(albumID), market, &album); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := AlbumResponse{
+		Success:    true,
+		Album:      getAlbumInfo(album),
+		MatchScore: score,
+	}
+	if enrich {
+		if err := enrichTracks(r.Context(), client, album.Tracks.Items, response.Album.Tracks, market); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+	}
+	if prefetch {
+		prefetchPage(client, album.Tracks.Next)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleMoreAlbums lists the most popular other albums of an album's primary
+// artist, given by id or found by q. Reissues are removed as by
+// dedupeReleases, and so are the album's own other editions. The artist's
+// album pages lack popularity, so the albums are looked up again in batches.
+// Results are cached for CacheTTL.
+func handleMoreAlbums(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	albumID := v.id(r, "album")
+	var query string
+	if albumID == "" {
+		query = v.searchText(r, "q")
+	}
+	limit := v.intRange(r, "limit", 5, 1, 20)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var album spotifyAlbum
+	response := MoreAlbumsResponse{Success: true}
+	if albumID == "" {
+		if err := searchFirst(r.Context(), client, query, "album", market, &album); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		response.MatchScore = matchScore(query, withArtists(album.Name, album.Artists)...)
+	} else if err := getInMarket(r.Context(), client, "/albums/"+url.PathEscape(albumID), market, &album); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	artistID := primaryArtistID(album)
+	if artistID == "" {
+		writeNotFound(w, r, "No artist found for album")
+		return
+	}
+	response.Album = album.Name
+	response.Artist = album.Artists[0].Name
+
+	cacheKey := fmt.Sprintf("more-albums:%s|%s|%d", album.ID, market, limit)
+	if getCachedResult(r.Context(), client, cacheKey, &response.Albums) {
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	albums, err := fetchAllAlbums(r.Context(), client, artistID, market, "album")
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	var ids []string
+	for _, other := range dedupeReleases(albums) {
+		if other.ID != album.ID && editionTitle(other.Name) != editionTitle(album.Name) {
+			ids = append(ids, other.ID)
+		}
+	}
+
+	var failures subCallFailures
+	full := fetchAlbumsByID(r.Context(), client, ids, market, &failures)
+	if failures.first != nil {
+		writeUpstreamError(w, r, failures.first)
+		return
+	}
+	var popular []spotifyAlbum
+	for _, other := range full {
+		if other != nil {
+			popular = append(popular, *other)
+		}
+	}
+	sort.SliceStable(popular, func(i, j int) bool { return popular[i].Popularity > popular[j].Popularity })
+	if len(popular) > limit {
+		popular = popular[:limit]
+	}
+
+	response.Albums = make([]MoreAlbum, len(popular))
+	for i, other := range popular {
+		thumbnail, cover := getImageSizes(other.Images)
+		response.Albums[i] = MoreAlbum{
+			Name:        other.Name,
+			ID:          other.ID,
+			URL:         other.ExternalURLs.Spotify,
+			ReleaseDate: other.ReleaseDate,
+			TotalTracks: other.TotalTracks,
+			Popularity:  other.Popularity,
+			Thumbnail:   thumbnail,
+			Cover:       cover,
+		}
+	}
+	setCachedResult(client, cacheKey, response.Albums, client.CacheTTL)
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// maxTrackIDsPerRequest is the most ids Spotify accepts in one /tracks call.
+const maxTrackIDsPerRequest = 50
+
+// enrichTracks sets the popularity, explicit flag and preview URL of each
+// track in basics, which must correspond to tracks index by index. Album
+// track objects lack popularity, so the full tracks are looked up
+// maxTrackIDsPerRequest at a time.
+func enrichTracks(ctx context.Context, client *SpotifyClient, tracks []spotifyTrack, basics []TrackBasic, market string) error {
+	// Local tracks have no ID and can't be looked up.
+	var ids []string
+	var indexes []int
+	for i, track := range tracks {
+		if track.ID != "" {
+			ids = append(ids, track.ID)
+			indexes = append(indexes, i)
+		}
+	}
+
+	for start := 0; start < len(ids); start += maxTrackIDsPerRequest {
+		end := start + maxTrackIDsPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var result struct {
+			Tracks []*spotifyTrack `json:"tracks"`
+		}
+		if err := client.getJSON(ctx, withMarket("/tracks?ids="+strings.Join(ids[start:end], ","), market), &result); err != nil {
+			return err
+		}
+		for i, track := range result.Tracks {
+			if track == nil || start+i >= end {
+				continue
+			}
+			popularity, explicit := track.Popularity, track.Explicit
+			basic := &basics[indexes[start+i]]
+			basic.Popularity = &popularity
+			basic.Explicit = &explicit
+			basic.PreviewURL = track.PreviewURL
+		}
+	}
+	return nil
+}
+
+// maxAlbumsPerRequest is the most ids Spotify accepts in one /albums call.
+const maxAlbumsPerRequest = 20
+
+// fetchFullAlbums looks up albums with all of their tracks, returning them
+// in the order of ids. The batches of maxAlbumsPerRequest, and then the
+// further track pages of albums longer than 50 tracks, are fetched
+// concurrently with runParallel. An album that fails, or that Spotify
+// doesn't know, is left nil; failures are recorded under "albums" rather
+// than failing the rest.
+func fetchFullAlbums(ctx context.Context, client *SpotifyClient, ids []string, market string, failures *subCallFailures) []*spotifyAlbum {
+	full := fetchAlbumsByID(ctx, client, ids, market, failures)
+
+	// The lookup includes the first 50 tracks; page through the rest.
+	var tasks []func(ctx context.Context) error
+	for i, album := range full {
+		if album == nil || album.Tracks.Next == "" {
+			continue
+		}
+		i, album := i, album
+		tasks = append(tasks, func(ctx context.Context) error {
+			tracks, err := fetchAllAlbumTracks(ctx, client, album.ID, market)
+			if err != nil {
+				failures.add("albums", err)
+				full[i] = nil
+				return nil
+			}
+			album.Tracks.Items, album.Tracks.Next = tracks, ""
+			return nil
+		})
+	}
+	runParallel(ctx, tasks...)
+	return full
+}
+
+// fetchAlbumsByID looks albums up by id in batches of maxAlbumsPerRequest,
+// fetched concurrently, returning them in the order of ids. Albums that
+// fail or that Spotify doesn't know are left nil; failures are recorded
+// under "albums".
+func fetchAlbumsByID(ctx context.Context, client *SpotifyClient, ids []string, market string, failures *subCallFailures) []*spotifyAlbum {
+	full := make([]*spotifyAlbum, len(ids))
+	var tasks []func(ctx context.Context) error
+	for start := 0; start < len(ids); start += maxAlbumsPerRequest {
+		start := start
+		end := start + maxAlbumsPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+		tasks = append(tasks, func(ctx context.Context) error {
+			var result struct {
+				Albums []*spotifyAlbum `json:"albums"`
+			}
+			if err := client.getJSON(ctx, withMarket("/albums?ids="+strings.Join(ids[start:end], ","), market), &result); err != nil {
+				failures.add("albums", err)
+				return nil
+			}
+			for i, album := range result.Albums {
+				if start+i < end {
+					full[start+i] = album
+				}
+			}
+			return nil
+		})
+	}
+	runParallel(ctx, tasks...)
+	return full
+}
+
+// searchBestEdition searches for albums matching query and picks the
+// canonical edition instead of the first result, which is often a single or
+// a regional copy. Of the results, those by the same primary artist and with
+// the same title, ignoring edition suffixes such as "(Deluxe)" or
+// " - Remastered", as the result that best matches the query are the
+// candidates. They are ranked by type (album, then compilation, then single),
+// then by most tracks, then by earliest release date, with ties left in search
+// order.
+func searchBestEdition(ctx context.Context, client *SpotifyClient, query, market string) (spotifyAlbum, error) {
+	var searchResult struct {
+		Albums struct {
+			Items []*spotifyAlbum `json:"items"`
+		} `json:"albums"`
+	}
+	if err := client.getJSON(ctx, withMarket(fmt.Sprintf("/search?q=%s&type=album&limit=%d", url.QueryEscape(query), maxAlbumsPerRequest), market), &searchResult); err != nil {
+		return spotifyAlbum{}, err
+	}
+
+	var albums []spotifyAlbum
+	for _, album := range searchResult.Albums.Items {
+		if album != nil {
+			albums = append(albums, *album)
+		}
+	}
+	if len(albums) == 0 {
+		return spotifyAlbum{}, &NotFoundError{SearchType: "album"}
+	}
+
+	best, bestScore := albums[0], -1.0
+	for _, album := range albums {
+		if score := *matchScore(query, withArtists(editionTitle(album.Name), album.Artists)...); score > bestScore {
+			best, bestScore = album, score
+		}
+	}
+
+	var editions []spotifyAlbum
+	for _, album := range albums {
+		if editionTitle(album.Name) == editionTitle(best.Name) && primaryArtistID(album) == primaryArtistID(best) {
+			editions = append(editions, album)
+		}
+	}
+	sort.SliceStable(editions, func(i, j int) bool {
+		a, b := editions[i], editions[j]
+		if albumTypeRank(a.AlbumType) != albumTypeRank(b.AlbumType) {
+			return albumTypeRank(a.AlbumType) < albumTypeRank(b.AlbumType)
+		}
+		if a.TotalTracks != b.TotalTracks {
+			return a.TotalTracks > b.TotalTracks
+		}
+		// Release dates are YYYY, YYYY-MM or YYYY-MM-DD, which sort as text.
+		return a.ReleaseDate < b.ReleaseDate
+	})
+	return editions[0], nil
+}
+
+// editionSuffix matches a trailing edition marker such as " (Deluxe)",
+// " [Remastered 2011]" or " - Live".
+var editionSuffix = regexp.MustCompile(`\s*(\([^)]*\)|\[[^\]]*\]|\s-\s.*)$`)
+
+// editionTitle returns an album name without its edition markers, normalized
+// like matchScore does.
+func editionTitle(name string) string {
+	for {
+		stripped := editionSuffix.ReplaceAllString(name, "")
+		if stripped == name || stripped == "" {
+			return normalizeForMatch(name)
+		}
+		name = stripped
+	}
+}
+
+func primaryArtistID(album spotifyAlbum) string {
+	if len(album.Artists) == 0 {
+		return ""
+	}
+	return album.Artists[0].ID
+}
+
+func albumTypeRank(albumType string) int {
+	switch albumType {
+	case "album":
+		return 0
+	case "compilation":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// handleAlbumEditions returns every edition (standard, deluxe, remaster, ...)
+// of an album by an artist together with its UPC, so callers can pick the
+// right one.
+func handleAlbumEditions(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	// Quotes can't be escaped inside a filter value, so drop them.
+	filterValue := func(field string) string {
+		value := v.searchText(r, field)
+		unquoted := strings.Replace(value, `"`, "", -1)
+		if value != "" && strings.TrimSpace(unquoted) == "" {
+			v.add(field, fmt.Sprintf("%s must contain more than quotes", field))
+		}
+		return unquoted
+	}
+	albumName := filterValue("album")
+	artistName := filterValue("artist")
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	query := `album:"` + albumName + `" artist:"` + artistName + `"`
+	var searchResult struct {
+		Albums spotifyAlbumPage `json:"albums"`
+	}
+	if err := client.getJSON(r.Context(), withMarket(fmt.Sprintf("/search?q=%s&type=album&limit=%d", url.QueryEscape(query), maxAlbumsPerRequest), market), &searchResult); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Search results don't include UPCs, so look the albums up in one batch.
+	var ids []string
+	for _, album := range searchResult.Albums.Items {
+		if album.ID != "" {
+			ids = append(ids, album.ID)
+		}
+	}
+	if len(ids) == 0 {
+		writeNotFound(w, r, "No album found")
+		return
+	}
+
+	var albumsResult struct {
+		Albums []*spotifyAlbum `json:"albums"`
+	}
+	if err := client.getJSON(r.Context(), withMarket("/albums?ids="+strings.Join(ids, ","), market), &albumsResult); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	editions := []AlbumEdition{}
+	seen := make(map[string]bool)
+	for _, album := range albumsResult.Albums {
+		if album == nil {
+			continue
+		}
+		edition := AlbumEdition{
+			Name:        album.Name,
+			ID:          album.ID,
+			UPC:         album.ExternalIDs["upc"],
+			ReleaseDate: album.ReleaseDate,
+			TotalTracks: album.TotalTracks,
+			Type:        album.AlbumType,
+			URL:         album.ExternalURLs.Spotify,
+		}
+
+		// The same release is often listed more than once (e.g. clean and
+		// explicit versions share a UPC, or regional copies share everything
+		// else); keep only the first of each.
+		key := edition.UPC
+		if key == "" {
+			key = fmt.Sprintf("%s|%s|%d", strings.ToLower(edition.Name), edition.ReleaseDate, edition.TotalTracks)
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		editions = append(editions, edition)
+	}
+
+	writeJSON(w, r, http.StatusOK, AlbumEditionsResponse{Success: true, Editions: editions})
+}
+
+// handleArtistStats returns everything the short and full artist endpoints
+// do, with album counts taken over all of the artist's releases rather than
+// one page. Top tracks and albums are fetched concurrently.
+func handleArtistStats(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	color := v.boolean(r, "color", false)
+	noCompilations := v.boolean(r, "exclude_compilations", false)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+	ctx, cancel := budgetContext(r)
+	defer cancel()
+
+	var artist spotifyArtist
+	if err := searchFirst(ctx, client, query, "artist", market, &artist); err != nil {
+		writeBudgetedError(w, r, ctx, err)
+		return
+	}
+
+	topMarket := market
+	if topMarket == "" {
+		topMarket = "US"
+	}
+	var groups string
+	if noCompilations {
+		groups = nonCompilationGroups
+	}
+
+	// Sub-calls record their failures instead of returning them so that one
+	// failing doesn't cancel the other.
+	var failures subCallFailures
+	topTracks := []TrackInfo{}
+	var albums []spotifyAlbum
+	runParallel(ctx,
+		func(ctx context.Context) error {
+			var result struct {
+				Tracks []spotifyTrack `json:"tracks"`
+			}
+			if err := client.getJSON(ctx, withMarket("/artists/"+artist.ID+"/top-tracks", topMarket), &result); err != nil {
+				failures.add("topTracks", err)
+				return nil
+			}
+			for _, track := range result.Tracks {
+				topTracks = append(topTracks, getTrackInfo(track))
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			var err error
+			if albums, err = fetchAllAlbums(ctx, client, artist.ID, market, groups); err != nil {
+				failures.add("albums", err)
+			}
+			return nil
+		},
+	)
+	// Albums paged partway still count as collected.
+	if failures.all(2) && len(albums) == 0 {
+		writeBudgetedError(w, r, ctx, failures.first)
+		return
+	}
+
+	stats := getAlbumStats(albums)
+	response := ArtistStatsResponse{
+		Success: true,
+		Artist: ArtistStatsInfo{
+			ArtistInfo: getArtistInfo(artist, stats),
+			TopTracks:  topTracks,
+			AlbumStats: stats,
+		},
+		MatchScore: matchScore(query, artist.Name),
+		Partial:    len(failures.warnings) > 0,
+		Warnings:   failures.warnings,
+		Complete:   budgetComplete(ctx),
+	}
+	if color {
+		response.Artist.Color = artistColor(ctx, client, artist)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleArtistTrackCount counts the tracks on all of an artist's own
+// releases. Album pages already carry each release's track count, so this
+// takes one call per 50 releases rather than one per album. Reissues are
+// counted once: of the releases of one type that share a title once edition
+// suffixes are ignored (see editionTitle), only the one with the most tracks
+// counts. Tracks released both as a single and on an album count for each.
+// Totals are cached like Spotify responses, as they take many calls.
+func handleArtistTrackCount(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := ArtistTrackCountResponse{
+		Success:    true,
+		Artist:     artist.Name,
+		MatchScore: matchScore(query, artist.Name),
+	}
+
+	cacheKey := "track-count:" + artist.ID + "|" + market
+	if getCachedResult(r.Context(), client, cacheKey, &response.ArtistTrackCounts) {
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	albums, err := fetchAllAlbums(r.Context(), client, artist.ID, market, "")
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	counted := dedupeReleases(albums)
+	for _, album := range counted {
+		response.TotalTracks += album.TotalTracks
+		switch album.AlbumType {
+		case "album":
+			response.Tracks.Album += album.TotalTracks
+		case "single":
+			response.Tracks.Single += album.TotalTracks
+		case "compilation":
+			response.Tracks.Compilation += album.TotalTracks
+		}
+	}
+	response.Releases = getAlbumStats(counted)
+	setCachedResult(client, cacheKey, response.ArtistTrackCounts, client.CacheTTL)
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// dedupeReleases returns the artist's own releases from albums, leaving out
+// those they only appear on, with reissues removed: of the releases of one
+// type that share a title once edition suffixes are ignored, only the first
+// with the most tracks is kept. Order is preserved.
+func dedupeReleases(albums []spotifyAlbum) []spotifyAlbum {
+	releases := make(map[string]int)
+	var kept []spotifyAlbum
+	for _, album := range albums {
+		if album.AlbumGroup == "appears_on" {
+			continue
+		}
+		key := album.AlbumType + "|" + editionTitle(album.Name)
+		i, ok := releases[key]
+		switch {
+		case !ok:
+			releases[key] = len(kept)
+			kept = append(kept, album)
+		case album.TotalTracks > kept[i].TotalTracks:
+			kept[i] = album
+		}
+	}
+	return kept
+}
+
+// latestReleaseTypes are the values of /spotify/artist/latest's type
+// parameter, which are also Spotify album groups.
+var latestReleaseTypes = []string{"album", "single"}
+
+// handleArtistGenres returns the artist's genres, each placed in a bundled
+// hierarchy, and grouped by family. See classifyGenre.
+func handleArtistGenres(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), spotifyClient, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := ArtistGenresResponse{
+		Success:      true,
+		Artist:       artist.Name,
+		MatchScore:   matchScore(query, artist.Name),
+		Genres:       []ArtistGenre{},
+		Families:     []GenreFamily{},
+		Unclassified: []string{},
+	}
+	families := make(map[string]int)
+	for _, genre := range artist.Genres {
+		parents, family := classifyGenre(genre)
+		response.Genres = append(response.Genres, ArtistGenre{Name: genre, Parents: parents, Family: family})
+		if family == "" {
+			response.Unclassified = append(response.Unclassified, genre)
+			continue
+		}
+		i, ok := families[family]
+		if !ok {
+			i = len(response.Families)
+			families[family] = i
+			response.Families = append(response.Families, GenreFamily{Family: family})
+		}
+		response.Families[i].Genres = append(response.Families[i].Genres, genre)
+	}
+	// Ties keep Spotify's order, which puts the most relevant genres first.
+	sort.SliceStable(response.Families, func(i, j int) bool {
+		return len(response.Families[i].Genres) > len(response.Families[j].Genres)
+	})
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// genreParents is the bundled genre hierarchy: each genre's nearest broader
+// genre. Genres without a parent here but used as one are families. It is a
+// hand-made heuristic, not data from Spotify, and covers common genres only.
+var genreParents = map[string]string{
+	// pop
+	"dance pop": "pop", "electropop": "pop", "synthpop": "pop", "k-pop": "pop",
+	"j-pop": "pop", "c-pop": "pop", "mandopop": "pop", "cantopop": "pop",
+	"bubblegum pop": "pop", "boy band": "pop", "girl group": "pop",
+	// rock
+	"metal": "rock", "punk": "rock", "grunge": "rock", "emo": "rock",
+	"shoegaze": "rock", "indie": "rock", "new wave": "rock", "j-rock": "rock",
+	"britpop": "rock", "post-punk": "punk", "hardcore": "punk",
+	"metalcore": "metal", "deathcore": "metal", "djent": "metal",
+	"death metal": "metal", "black metal": "metal", "thrash metal": "metal",
+	// hip hop
+	"rap": "hip hop", "trap": "hip hop", "drill": "hip hop", "grime": "hip hop",
+	"boom bap": "hip hop", "phonk": "hip hop", "k-rap": "hip hop",
+	"hip-hop": "hip hop",
+	// r&b
+	"soul": "r&b", "funk": "r&b", "quiet storm": "r&b", "new jack swing": "r&b",
+	"motown": "soul", "neo soul": "soul", "disco": "funk",
+	// electronic
+	"house": "electronic", "techno": "electronic", "trance": "electronic",
+	"edm": "electronic", "dubstep": "electronic", "drum and bass": "electronic",
+	"electro": "electronic", "electronica": "electronic", "ambient": "electronic",
+	"idm": "electronic", "breakbeat": "electronic", "downtempo": "electronic",
+	"synthwave": "electronic", "hardstyle": "electronic", "uk garage": "electronic",
+	"jungle": "drum and bass", "liquid funk": "drum and bass",
+	"big room": "edm", "future bass": "edm", "brostep": "dubstep",
+	// jazz
+	"bebop": "jazz", "swing": "jazz", "big band": "jazz", "smooth jazz": "jazz",
+	"jazz fusion": "jazz",
+	// classical
+	"baroque": "classical", "opera": "classical", "choral": "classical",
+	"orchestra": "classical", "early music": "classical",
+	// country
+	"bluegrass": "country", "americana": "country", "honky tonk": "country",
+	"outlaw country": "country",
+	// folk
+	"singer-songwriter": "folk", "folk rock": "folk", "chanson": "folk",
+	// latin
+	"reggaeton": "latin", "salsa": "latin", "bachata": "latin", "cumbia": "latin",
+	"bossa nova": "latin", "samba": "latin", "latino": "latin", "corrido": "latin",
+	"corridos tumbados": "corrido", "banda": "latin", "mariachi": "latin",
+	"regional mexican": "latin", "trap latino": "latin", "urbano latino": "latin",
+	"dembow": "reggaeton",
+	// reggae
+	"dancehall": "reggae", "dub": "reggae", "ska": "reggae", "rocksteady": "reggae",
+	// african
+	"afrobeats": "african", "afropop": "african", "amapiano": "african",
+	"highlife": "african", "afrobeat": "african",
+	// blues
+	"delta blues": "blues", "electric blues": "blues",
+}
+
+// genreFamilies are the top-level genres of genreParents.
+var genreFamilies = func() map[string]bool {
+	families := make(map[string]bool)
+	for _, parent := range genreParents {
+		if _, ok := genreParents[parent]; !ok {
+			families[parent] = true
+		}
+	}
+	return families
+}()
+
+// classifyGenre places a Spotify genre in genreParents and returns its
+// broader genres, nearest first, and its family. Spotify genres are mostly
+// a known genre qualified by words such as a place or "deep", so a genre
+// not in the hierarchy is matched by its longest known ending ("canadian
+// contemporary r&b" by "r&b"), then by its longest known beginning
+// ("reggaeton colombiano" by "reggaeton"). The family is "" when nothing matches.
+func classifyGenre(genre string) ([]string, string) {
+	genre = strings.ToLower(strings.TrimSpace(genre))
+	known := func(g string) bool {
+		_, ok := genreParents[g]
+		return ok || genreFamilies[g]
+	}
+
+	root := ""
+	words := strings.Fields(genre)
+	for i := 0; i < len(words) && root == ""; i++ {
+		if candidate := strings.Join(words[i:], " "); known(candidate) {
+			root = candidate
+		}
+	}
+	for i := len(words) - 1; i > 0 && root == ""; i-- {
+		if candidate := strings.Join(words[:i], " "); known(candidate) {
+			root = candidate
+		}
+	}
+	if root == "" {
+		return []string{}, ""
+	}
+
+	parents := []string{}
+	if root != genre {
+		parents = append(parents, root)
+	}
+	family := root
+	// The bound guards against a cycle slipping into genreParents.
+	for i := 0; i < len(genreParents); i++ {
+		parent, ok := genreParents[family]
+		if !ok {
+			break
+		}
+		parents = append(parents, parent)
+		family = parent
+	}
+	return parents, family
+}
+
+// latestReleaseTTL is how long /spotify/artist/latest caches an artist's
+// latest release. It is kept short so new releases show up soon.
+var latestReleaseTTL = time.Minute
+
+// handleArtistLatest returns the artist's most recent album or single, or of
+// the one type given by type. Reissues don't count as new: see
+// latestRelease. Results are cached for latestReleaseTTL.
+func handleArtistLatest(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	releaseType := r.URL.Query().Get("type")
+	if releaseType != "" && !containsString(latestReleaseTypes, releaseType) {
+		v.add("type", fmt.Sprintf("type must be one of: %s", strings.Join(latestReleaseTypes, ", ")))
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := ArtistLatestResponse{
+		Success:    true,
+		Artist:     artist.Name,
+		MatchScore: matchScore(query, artist.Name),
+	}
+
+	cacheKey := "latest:" + artist.ID + "|" + market + "|" + releaseType
+	if getCachedResult(r.Context(), client, cacheKey, &response.Release) {
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	groups := releaseType
+	if groups == "" {
+		groups = strings.Join(latestReleaseTypes, ",")
+	}
+	albums, err := fetchAllAlbums(r.Context(), client, artist.ID, market, groups)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	releases := latestReleases(albums, "")
+	if len(releases) == 0 {
+		writeNotFound(w, r, "No releases found")
+		return
+	}
+	latest := releases[0]
+
+	var album spotifyAlbum
+	if err := getInMarket(r.Context(), client, "/albums/"+url.PathEscape(latest.ID), market, &album); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	response.Release = getAlbumInfo(album)
+	setCachedResult(client, cacheKey, response.Release, latestReleaseTTL)
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// latestReleases returns those of albums released after since, a release
+// date, newest first; with since "" it returns them all. Releases of one
+// type that share a title once edition suffixes are ignored (see
+// editionTitle) count as released on the earliest of their dates, so that
+// regional reissues, remasters and deluxe editions of an older release
+// aren't mistaken for new ones. /spotify/artist/latest and the release
+// watches both use it, so they agree on what is new.
+func latestReleases(albums []spotifyAlbum, since string) []spotifyAlbum {
+	originals := make(map[string]int)
+	var kept []spotifyAlbum
+	for _, album := range albums {
+		key := album.AlbumType + "|" + editionTitle(album.Name)
+		i, ok := originals[key]
+		switch {
+		case !ok:
+			originals[key] = len(kept)
+			kept = append(kept, album)
+		case releasedBefore(album, kept[i]):
+			kept[i] = album
+		}
+	}
+
+	var releases []spotifyAlbum
+	for _, album := range kept {
+		if since == "" || releasedBefore(spotifyAlbum{ReleaseDate: since}, album) {
+			releases = append(releases, album)
+		}
+	}
+	sort.SliceStable(releases, func(i, j int) bool { return releasedBefore(releases[j], releases[i]) })
+	return releases
+}
+
+// releasedBefore reports whether a was released before b. Spotify gives
+// some release dates only to the year or month; these count as the first
+// day of that year or month, and before a full date on that day.
+func releasedBefore(a, b spotifyAlbum) bool {
+	dayA, dayB := releaseDay(a.ReleaseDate), releaseDay(b.ReleaseDate)
+	if dayA != dayB {
+		return dayA < dayB
+	}
+	return len(a.ReleaseDate) < len(b.ReleaseDate)
+}
+
+// releaseDay pads a release date of the form 2006 or 2006-01 to a full
+// date, 2006-01-01.
+func releaseDay(date string) string {
+	switch len(date) {
+	case 4:
+		return date + "-01-01"
+	case 7:
+		return date + "-01"
+	}
+	return date
+}
+
+// getCachedResult decodes a result computed from several Spotify calls and
+// stored under key by setCachedResult into v, reporting whether it was
+// found and still fresh.
+func getCachedResult(ctx context.Context, client *SpotifyClient, key string, v interface{}) bool {
+	if client.Cache == nil {
+		return false
+	}
+	cached, ok := client.Cache.Get(key)
+	if !ok || !time.Now().Before(cached.FreshUntil) {
+		return false
+	}
+	if json.Unmarshal(cached.Data, v) != nil {
+		return false
+	}
+	markServedFromCache(ctx)
+	return true
+}
+
+// setCachedResult stores a computed result in the client's cache for ttl,
+// if it has one. Keys must not look like Spotify endpoints.
+func setCachedResult(client *SpotifyClient, key string, v interface{}, ttl time.Duration) {
+	if client.Cache == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	client.Cache.Set(key, cachedResponse{Data: data, FreshUntil: time.Now().Add(ttl)}, ttl)
+}
+
+// handleArtistExport returns everything about an artist in one bundle: the
+// artist, top tracks, related artists and every one of their own releases
+// with its full track list, reissues removed as by dedupeReleases. It takes
+// a call each for the search, top tracks and related artists, one per 50
+// releases, one per 20 deduplicated releases and one per further 50 tracks
+// of longer albums, so complete bundles are cached for CacheTTL. If some
+// calls fail the rest is still returned, marked as partial.
+func handleArtistExport(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+	ctx, cancel := budgetContext(r)
+	defer cancel()
+
+	var artist spotifyArtist
+	if err := searchFirst(ctx, client, query, "artist", market, &artist); err != nil {
+		writeBudgetedError(w, r, ctx, err)
+		return
+	}
+
+	response := ArtistExportResponse{
+		Success:    true,
+		MatchScore: matchScore(query, artist.Name),
+	}
+	cacheKey := "export:" + artist.ID + "|" + market
+	if getCachedResult(ctx, client, cacheKey, &response.ArtistExport) {
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	topMarket := market
+	if topMarket == "" {
+		topMarket = "US"
+	}
+	var failures subCallFailures
+	var topTracks []spotifyTrack
+	var related []spotifyArtist
+	var albums []spotifyAlbum
+	runParallel(ctx,
+		func(ctx context.Context) error {
+			var result struct {
+				Tracks []spotifyTrack `json:"tracks"`
+			}
+			if err := client.getJSON(ctx, withMarket("/artists/"+artist.ID+"/top-tracks", topMarket), &result); err != nil {
+				failures.add("topTracks", err)
+			}
+			topTracks = result.Tracks
+			return nil
+		},
+		func(ctx context.Context) error {
+			var result struct {
+				Artists []spotifyArtist `json:"artists"`
+			}
+			if err := client.getJSON(ctx, "/artists/"+artist.ID+"/related-artists", &result); err != nil {
+				failures.add("relatedArtists", err)
+			}
+			related = result.Artists
+			return nil
+		},
+		func(ctx context.Context) error {
+			var err error
+			if albums, err = fetchAllAlbums(ctx, client, artist.ID, market, ""); err != nil {
+				failures.add("albums", err)
+			}
+			return nil
+		},
+	)
+	// Albums paged partway still count as collected.
+	if failures.all(3) && len(albums) == 0 {
+		writeBudgetedError(w, r, ctx, failures.first)
+		return
+	}
+
+	releases := dedupeReleases(albums)
+	ids := make([]string, len(releases))
+	for i, album := range releases {
+		ids[i] = album.ID
+	}
+	full := fetchFullAlbums(ctx, client, ids, market, &failures)
+
+	response.Artist = getArtistInfo(artist, getAlbumStats(releases))
+	response.TopTracks = make([]TrackInfo, len(topTracks))
+	for i, track := range topTracks {
+		response.TopTracks[i] = getTrackInfo(track)
+	}
+	response.RelatedArtists = make([]SimilarArtist, len(related))
+	for i, a := range related {
+		response.RelatedArtists[i] = getSimilarArtist(a)
+	}
+	response.Albums = []AlbumInfo{}
+	for _, album := range full {
+		if album != nil {
+			response.Albums = append(response.Albums, getAlbumInfo(*album))
+		}
+	}
+	response.ExportedAt = time.Now().UTC()
+	response.Warnings = failures.warnings
+	response.Partial = len(failures.warnings) > 0
+	response.Complete = budgetComplete(ctx)
+
+	if !response.Partial {
+		setCachedResult(client, cacheKey, response.ArtistExport, client.CacheTTL)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleAppearsOn lists albums by other artists that the artist appears on,
+// such as compilations and features.
+func handleAppearsOn(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	market := v.market(r)
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	offset := v.intRange(r, "offset", 0, 0, 10000)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var artist spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	var page spotifyAlbumPage
+	if err := client.getJSON(r.Context(), withMarket(albumsEndpoint(artist.ID, limit, offset)+"&include_groups=appears_on", market), &page); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// The same release often appears once per market or edition; list it
+	// once per name, artists and release date.
+	albums := []AppearsOnAlbum{}
+	seen := make(map[string]bool)
+	for _, album := range page.Items {
+		key := strings.ToLower(album.Name + "|" + artistNames(album.Artists) + "|" + album.ReleaseDate)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		albums = append(albums, AppearsOnAlbum{
+			Name:        album.Name,
+			ID:          album.ID,
+			Artists:     getArtists(album.Artists),
+			ReleaseDate: album.ReleaseDate,
+			Type:        album.AlbumType,
+			URL:         album.ExternalURLs.Spotify,
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, AppearsOnResponse{
+		Success:    true,
+		Artist:     artist.Name,
+		MatchScore: matchScore(query, artist.Name),
+		Albums:     albums,
+		Total:      page.Total,
+		Next:       page.Next,
+	})
+}
+
+// handleSimilarArtists merges Spotify's related artists with artists from the
+// seed artist's top genre, most popular first.
+func handleSimilarArtists(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.artistQuery(r)
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var seed spotifyArtist
+	if err := searchFirst(r.Context(), client, query, "artist", market, &seed); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	var failures subCallFailures
+	var related, byGenre []spotifyArtist
+	tasks := []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			var result struct {
+				Artists []spotifyArtist `json:"artists"`
+			}
+			if err := client.getJSON(ctx, "/artists/"+seed.ID+"/related-artists", &result); err != nil {
+				failures.add("relatedArtists", err)
+			}
+			related = result.Artists
+			return nil
+		},
+	}
+	// Spotify lists an artist's genres most relevant first.
+	if len(seed.Genres) > 0 {
+		tasks = append(tasks, func(ctx context.Context) error {
+			var result struct {
+				Artists struct {
+					Items []spotifyArtist `json:"items"`
+				} `json:"artists"`
+			}
+			// Quotes can't be escaped inside a filter value, so drop them.
+			genreQuery := `genre:"` + strings.Replace(seed.Genres[0], `"`, "", -1) + `"`
+			if err := client.getJSON(ctx, withMarket("/search?q="+url.QueryEscape(genreQuery)+"&type=artist&limit=50", market), &result); err != nil {
+				failures.add("genreArtists", err)
+			}
+			byGenre = result.Artists.Items
+			return nil
+		})
+	}
+	runParallel(r.Context(), tasks...)
+	if failures.all(len(tasks)) {
+		writeUpstreamError(w, r, failures.first)
+		return
+	}
+
+	artists := []SimilarArtist{}
+	seen := map[string]bool{seed.ID: true}
+	for _, artist := range append(related, byGenre...) {
+		if artist.ID == "" || seen[artist.ID] {
+			continue
+		}
+		seen[artist.ID] = true
+		artists = append(artists, getSimilarArtist(artist))
+	}
+	sort.SliceStable(artists, func(i, j int) bool { return artists[i].Popularity > artists[j].Popularity })
+	if len(artists) > limit {
+		artists = artists[:limit]
+	}
+
+	writeJSON(w, r, http.StatusOK, SimilarArtistsResponse{
+		Success:    true,
+		Artist:     seed.Name,
+		MatchScore: matchScore(query, seed.Name),
+		Artists:    artists,
+		Partial:    len(failures.warnings) > 0,
+		Warnings:   failures.warnings,
+	})
+}
+
+// budgetedEndpoints are the endpoints making many Spotify calls that
+// -time-budgets can set a time budget for.
+var budgetedEndpoints = []string{"/spotify/artist/export", "/spotify/artist/stats", "/spotify/artists/top-tracks", "/spotify/playlists/merge"}
+
+// timeBudgets bounds how long the Spotify calls of each budgeted endpoint
+// may take in total, by path, with "*" for the others. When a budget runs
+// out the calls still in flight are cancelled and the endpoint returns what
+// it has, with Complete false.
+var timeBudgets = map[string]time.Duration{}
+
+// parseTimeBudgets parses -time-budgets, a comma-separated list of
+// path=duration pairs such as /spotify/artist/export=10s,*=5s.
+func parseTimeBudgets(raw string) (map[string]time.Duration, error) {
+	budgets := make(map[string]time.Duration)
+	if raw == "" {
+		return budgets, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		path, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			path, value = pair[:i], pair[i+1:]
+		}
+		if path != "*" && !containsString(budgetedEndpoints, path) {
+			return nil, fmt.Errorf("%q is not one of %s or *", path, strings.Join(budgetedEndpoints, ", "))
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("budget for %s must be a positive duration such as 5s", path)
+		}
+		budgets[path] = d
+	}
+	return budgets, nil
+}
+
+// budgetContext returns the context for a budgeted endpoint's Spotify
+// calls: the request's, ending when the endpoint's time budget runs out if
+// it has one.
+func budgetContext(r *http.Request) (context.Context, context.CancelFunc) {
+	budget, ok := timeBudgets[r.URL.Path]
+	if !ok {
+		budget, ok = timeBudgets["*"]
+	}
+	if !ok {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), budget)
+}
+
+// budgetComplete returns a false Complete flag once ctx's time budget has
+// run out, and nil, leaving the flag out, while it hasn't.
+func budgetComplete(ctx context.Context) *bool {
+	if ctx.Err() != context.DeadlineExceeded {
+		return nil
+	}
+	complete := false
+	return &complete
+}
+
+// writeBudgetedError reports a failure of a budgeted endpoint, with 504 when
+// its time budget ran out before anything was collected.
+func writeBudgetedError(w http.ResponseWriter, r *http.Request, ctx context.Context, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		writeError(w, r, http.StatusGatewayTimeout, "time budget exceeded before anything was fetched")
+		return
+	}
+	writeUpstreamError(w, r, err)
+}
+
+// subCallFailures collects the sub-calls of a multi-call endpoint that failed,
+// so the endpoint can return what did succeed. It is safe for concurrent use.
+type subCallFailures struct {
+	mu       sync.Mutex
+	warnings []string
+	first    error
+}
+
+func (f *subCallFailures) add(resource string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.warnings = append(f.warnings, resource+": "+err.Error())
+	if f.first == nil {
+		f.first = err
+	}
+}
+
+// all reports whether all n sub-calls failed, leaving nothing to return.
+func (f *subCallFailures) all(n int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.warnings) == n
+}
+
+// fetchPlaylistItems returns a playlist's name and all of its items in
+// playlist order.
+func fetchPlaylistItems(ctx context.Context, client *SpotifyClient, playlistID, market string) (string, []spotifyPlaylistItem, error) {
+	var playlist struct {
+		Name   string                  `json:"name"`
+		Tracks spotifyPlaylistItemPage `json:"tracks"`
+	}
+	if err := client.getJSON(ctx, withMarket("/playlists/"+url.PathEscape(playlistID), market), &playlist); err != nil {
+		return "", nil, err
+	}
+
+	items := playlist.Tracks.Items
+	next := playlist.Tracks.Next
+	for next != "" {
+		endpoint, err := pagingEndpoint(next)
+		if err != nil {
+			return "", nil, err
+		}
+		var page spotifyPlaylistItemPage
+		if err := client.getJSON(ctx, endpoint, &page); err != nil {
+			return "", nil, err
+		}
+		items = append(items, page.Items...)
+		next = page.Next
+	}
+	return playlist.Name, items, nil
+}
+
+// handleUser returns the public profile of the Spotify user given by id,
+// such as a playlist's owner. It needs no login.
+func handleUser(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.require(r, "id")
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var user spotifyUser
+	if err := client.getJSON(r.Context(), "/users/"+url.PathEscape(id), &user); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.ID
+	}
+	writeJSON(w, r, http.StatusOK, UserResponse{
+		Success: true,
+		User: UserProfile{
+			ID:          user.ID,
+			DisplayName: displayName,
+			Followers:   user.Followers.Total,
+			URL:         user.ExternalURLs.Spotify,
+			Images:      getImages(user.Images),
+		},
+	})
+}
+
+// playlistFields limits a playlist lookup to what PlaylistInfo shows, so
+// Spotify doesn't send the first 100 tracks along.
+const playlistFields = "id,name,description,public,owner(id,display_name),external_urls,images,tracks.total,followers.total"
+
+// handlePlaylist returns a playlist given by id, or the first search result
+// for q. Search results are simplified playlists without followers, and
+// often without public set; hydrate=true looks the result up again to fill
+// them in.
+func handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.id(r, "playlist")
+	var query string
+	if id == "" {
+		query = v.searchText(r, "q")
+	}
+	hydrate := v.boolean(r, "hydrate", false)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var playlist spotifyPlaylist
+	response := PlaylistResponse{Success: true}
+	if query != "" {
+		if err := searchFirst(r.Context(), client, query, "playlist", market, &playlist); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		response.MatchScore = matchScore(query, playlist.Name)
+		id = playlist.ID
+	}
+	if query == "" || hydrate {
+		endpoint := withMarket("/playlists/"+url.PathEscape(id)+"?fields="+url.QueryEscape(playlistFields), market)
+		if err := client.getJSON(r.Context(), endpoint, &playlist); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+	}
+	response.Playlist = getPlaylist(playlist)
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// mosaicHost serves the covers Spotify generates for playlists without an
+// uploaded one, tiling the albums of their first tracks.
+const mosaicHost = "mosaic.scdn.co"
+
+// handlePlaylistImage lists the sizes of a playlist's cover. With size, it
+// also picks the image closest to that many pixels wide.
+func handlePlaylistImage(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.require(r, "id")
+	size := v.intRange(r, "size", 0, 1, 10000)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	var images []spotifyImage
+	if err := spotifyClient.getJSON(r.Context(), "/playlists/"+url.PathEscape(id)+"/images", &images); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := PlaylistImageResponse{
+		Success: true,
+		ID:      id,
+		Images:  getImages(images),
+	}
+	if len(images) > 0 {
+		response.Cover = "uploaded"
+		if u, err := url.Parse(images[0].URL); err == nil && u.Host == mosaicHost {
+			response.Cover = "mosaic"
+		}
+	}
+	if size > 0 {
+		response.Image = closestImage(response.Images, size)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// closestImage returns the image whose width is closest to size, preferring
+// the larger of two equally close so that it is scaled down rather than up.
+// Uploaded covers may have no dimensions; the first image is returned when
+// none of them has any. It returns nil when there are no images.
+func closestImage(images []ImageInfo, size int) *ImageInfo {
+	if len(images) == 0 {
+		return nil
+	}
+	best := -1
+	for i, img := range images {
+		if img.Width == 0 {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		diff, bestDiff := absInt(img.Width-size), absInt(images[best].Width-size)
+		if diff < bestDiff || diff == bestDiff && img.Width > images[best].Width {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = 0
+	}
+	return &images[best]
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// handlePlaylistDiff compares two playlists by track id.
+func handlePlaylistDiff(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	idA := v.require(r, "a")
+	idB := v.require(r, "b")
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var nameA, nameB string
+	var itemsA, itemsB []spotifyPlaylistItem
+	err := runParallel(r.Context(),
+		func(ctx context.Context) error {
+			var err error
+			nameA, itemsA, err = fetchPlaylistItems(ctx, client, idA, market)
+			return err
+		},
+		func(ctx context.Context) error {
+			var err error
+			nameB, itemsB, err = fetchPlaylistItems(ctx, client, idB, market)
+			return err
+		},
+	)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Tracks keep the order they first appear in, A before B. Local files and
+	// unavailable items have no id and are left out.
+	var order []string
+	tracks := make(map[string]*PlaylistDiffTrack)
+	count := func(items []spotifyPlaylistItem, inA bool) {
+		for _, item := range items {
+			if item.Track == nil || item.Track.ID == "" {
+				continue
+			}
+			t, ok := tracks[item.Track.ID]
+			if !ok {
+				t = &PlaylistDiffTrack{
+					ID:      item.Track.ID,
+					Name:    item.Track.Name,
+					Artists: artistNames(item.Track.Artists),
+					URL:     item.Track.ExternalURLs.Spotify,
+				}
+				tracks[t.ID] = t
+				order = append(order, t.ID)
+			}
+			if inA {
+				t.CountA++
+			} else {
+				t.CountB++
+			}
+		}
+	}
+	count(itemsA, true)
+	count(itemsB, false)
+
+	response := PlaylistDiffResponse{
+		Success: true,
+		A:       nameA,
+		B:       nameB,
+		OnlyInA: []PlaylistDiffTrack{},
+		OnlyInB: []PlaylistDiffTrack{},
+		Common:  []PlaylistDiffTrack{},
+	}
+	for _, id := range order {
+		t := tracks[id]
+		switch {
+		case t.CountB == 0:
+			response.OnlyInA = append(response.OnlyInA, *t)
+		case t.CountA == 0:
+			response.OnlyInB = append(response.OnlyInB, *t)
+		default:
+			response.Common = append(response.Common, *t)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handlePlaylistDuplicates finds duplicate tracks in a playlist without
+// changing it. Tracks match by id, or by ISRC when by=isrc so that the same
+// recording on different albums is caught too.
+func handlePlaylistDuplicates(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.require(r, "id")
+	by := "id"
+	if r.URL.Query().Get("by") != "" {
+		by = v.oneOf(r, "by", "id", "isrc")
+	}
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	name, items, err := fetchPlaylistItems(r.Context(), spotifyClient, id, market)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	var order []string
+	groups := make(map[string]*DuplicateGroup)
+	for position, item := range items {
+		if item.Track == nil || item.Track.ID == "" {
+			continue
+		}
+		key := trackKey(*item.Track, by)
+		g, ok := groups[key]
+		if !ok {
+			g = &DuplicateGroup{
+				Key:     key,
+				Name:    item.Track.Name,
+				Artists: artistNames(item.Track.Artists),
+			}
+			groups[key] = g
+			order = append(order, key)
+		}
+		if !containsString(g.IDs, item.Track.ID) {
+			g.IDs = append(g.IDs, item.Track.ID)
+		}
+		g.Positions = append(g.Positions, position)
+	}
+
+	response := DuplicatesResponse{
+		Success:  true,
+		Playlist: name,
+		By:       by,
+		Groups:   []DuplicateGroup{},
+	}
+	for _, key := range order {
+		if g := groups[key]; len(g.Positions) > 1 {
+			response.Groups = append(response.Groups, *g)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// maxMergePlaylists is the most playlists /spotify/playlists/merge reads.
+const maxMergePlaylists = 10
+
+// handlePlaylistMerge combines the tracks of several playlists into one
+// list, each track once in the order it is first seen. Tracks match by id,
+// or by ISRC when by=isrc. Local files and tracks Spotify can't play, in
+// the market when one is given, are skipped. Nothing is written to Spotify.
+func handlePlaylistMerge(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	ids := v.ids(r, "playlist", maxMergePlaylists)
+	by := "id"
+	if r.URL.Query().Get("by") != "" {
+		by = v.oneOf(r, "by", "id", "isrc")
+	}
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	names := make([]string, len(ids))
+	items := make([][]spotifyPlaylistItem, len(ids))
+	var failures subCallFailures
+	tasks := make([]func(ctx context.Context) error, len(ids))
+	for i, id := range ids {
+		i, id := i, id
+		tasks[i] = func(ctx context.Context) error {
+			var err error
+			if names[i], items[i], err = fetchPlaylistItems(ctx, spotifyClient, id, market); err != nil {
+				failures.add("playlist "+id, err)
+			}
+			return nil
+		}
+	}
+	ctx, cancel := budgetContext(r)
+	defer cancel()
+	runParallel(ctx, tasks...)
+	if failures.all(len(ids)) {
+		writeBudgetedError(w, r, ctx, failures.first)
+		return
+	}
+
+	response := MergeResponse{
+		Success:   true,
+		Playlists: names,
+		By:        by,
+		Tracks:    []TrackBasic{},
+		Partial:   len(failures.warnings) > 0,
+		Warnings:  failures.warnings,
+		Complete:  budgetComplete(ctx),
+	}
+	seen := make(map[string]bool)
+	var tracks []spotifyTrack
+	for _, playlist := range items {
+		for _, item := range playlist {
+			track := item.Track
+			if item.IsLocal || track == nil || track.ID == "" || track.IsPlayable != nil && !*track.IsPlayable {
+				response.Skipped++
+				continue
+			}
+			key := trackKey(*track, by)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			tracks = append(tracks, *track)
+		}
+	}
+	response.Tracks = append(response.Tracks, getTracks(tracks)...)
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// trackKey is what tracks are matched by: the track id, or the ISRC when by
+// is "isrc". Tracks without an ISRC can still be matched by id.
+func trackKey(track spotifyTrack, by string) string {
+	if isrc := track.ExternalIDs["isrc"]; by == "isrc" && isrc != "" {
+		return isrc
+	}
+	return track.ID
+}
+
+// fetchAllAlbums pages through all of an artist's albums. When a page fails,
+// as when a time budget runs out, the albums of the pages before it are
+// returned along with the error.
+func fetchAllAlbums(ctx context.Context, client *SpotifyClient, artistID, market, groups string) ([]spotifyAlbum, error) {
+	var albums []spotifyAlbum
+	endpoint := albumsEndpoint(artistID, 50, 0)
+	if groups != "" {
+		endpoint += "&include_groups=" + groups
+	}
+	endpoint = withMarket(endpoint, market)
+	for endpoint != "" {
+		var page spotifyAlbumPage
+		if err := client.getJSON(ctx, endpoint, &page); err != nil {
+			return albums, err
+		}
+		albums = append(albums, page.Items...)
+
+		endpoint = ""
+		if page.Next != "" {
+			var err error
+			if endpoint, err = pagingEndpoint(page.Next); err != nil {
+				return albums, err
+			}
+		}
+	}
+	return albums, nil
+}
+
+// maxConcurrency bounds how many upstream calls one request makes at once.
+var maxConcurrency = 4
+
+// prefetchSlots bounds the pages being prefetched at once across all
+// requests to maxConcurrency. It is made in main once flags are parsed.
+var prefetchSlots chan struct{}
+
+// prefetchPage fetches the page at next, a Spotify paging URL, in the
+// background so that following it with /spotify/page is served from the
+// cache. Each prefetch is an extra Spotify call, counted against the app's
+// rate limit whether or not the page is ever requested. It is skipped when
+// there is no cache, the cache is nearly full or maxConcurrency pages are
+// already being prefetched, and when the page is cached already no call is
+// made at all. A prefetch gives up after prefetchTimeout.
+func prefetchPage(client *SpotifyClient, next string) {
+	if next == "" || client.Cache == nil || cacheNearlyFull(client.Cache) {
+		return
+	}
+	endpoint, err := pagingEndpoint(next)
+	if err != nil {
+		return
+	}
+	select {
+	case prefetchSlots <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-prefetchSlots }()
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+		client.get(ctx, endpoint)
+	}()
+}
+
+// cacheNearlyFull reports whether an in-memory cache is using 90% of its
+// budget, when prefetched pages would only evict responses that were
+// actually requested. Redis evicts by its own policy, so only the in-memory
+// fallback of a fallbackCache is checked.
+func cacheNearlyFull(cache Cache) bool {
+	if fallback, ok := cache.(*fallbackCache); ok {
+		cache = fallback.fallback
+	}
+	memory, ok := cache.(*responseCache)
+	if !ok {
+		return false
+	}
+	stats := memory.stats()
+	return stats.Size >= stats.MaxSize/10*9
+}
+
+// runParallel runs tasks concurrently, at most maxConcurrency at a time. The
+// first error cancels the context passed to the remaining tasks and is
+// returned once all of them have finished.
+func runParallel(ctx context.Context, tasks ...func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task func(ctx context.Context) error) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := task(ctx); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(task)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// UserToken holds the authorization-code tokens of a logged-in user.
+type UserToken struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	Scope        string    `json:"scope"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// TokenStore persists the tokens of logged-in users, keyed by the session
+// ID in their cookie. A store that outlives the process, such as a file or
+// Redis, keeps users logged in across restarts. Implementations must be
+// safe for concurrent use.
+type TokenStore interface {
+	Get(id string) (UserToken, bool, error)
+	Set(id string, token UserToken) error
+	Delete(id string) error
+}
+
+// memoryTokenStore keeps tokens for the life of the process.
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]UserToken
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{tokens: make(map[string]UserToken)}
+}
+
+func (s *memoryTokenStore) Get(id string) (UserToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	return token, ok, nil
+}
+
+func (s *memoryTokenStore) Set(id string, token UserToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[id] = token
+	return nil
+}
+
+func (s *memoryTokenStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+	return nil
+}
+
+// tokens holds the tokens of logged-in users.
+var tokens TokenStore = newMemoryTokenStore()
+
+const (
+	sessionCookie = "spotify_session"
+	stateCookie   = "spotify_auth_state"
+)
+
+func randomID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// handleLogin starts Spotify's authorization-code flow. The space-separated
+// scopes to request are taken from the "scope" parameter.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	state := randomID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    state,
+		Path:     "/spotify/callback",
+		MaxAge:   600,
+		HttpOnly: true,
+	})
+
+	params := url.Values{}
+	params.Set("client_id", clientID)
+	params.Set("response_type", "code")
+	params.Set("redirect_uri", redirectURI)
+	params.Set("state", state)
+	if scope := r.URL.Query().Get("scope"); scope != "" {
+		params.Set("scope", scope)
+	}
+	http.Redirect(w, r, "https://accounts.spotify.com/authorize?"+params.Encode(), http.StatusFound)
+}
+
+// handleCallback completes the authorization-code flow and stores the user's
+// tokens in a new session identified by a cookie.
+func handleCallback(w http.ResponseWriter, r *http.Request) {
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		writeError(w, r, http.StatusUnauthorized, "Spotify authorization failed: "+errParam)
+		return
+	}
+
+	state, err := r.Cookie(stateCookie)
+	if err != nil || state.Value == "" || state.Value != r.URL.Query().Get("state") {
+		writeError(w, r, http.StatusBadRequest, "Invalid authorization state")
+		return
+	}
+
+	v := &validator{}
+	code := v.require(r, "code")
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+
+	tokenResp, err := spotifyClient.requestToken(r.Context(), data)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	sessionID := randomID()
+	err = tokens.Set(sessionID, UserToken{
+		AccessToken:  tokenResp.AccessToken,
+		RefreshToken: tokenResp.RefreshToken,
+		Scope:        tokenResp.Scope,
+		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Could not store session: "+err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"scope":   tokenResp.Scope,
+	})
+}
+
+// userClient returns a client that acts on behalf of the user logged in with
+// the request's session cookie. It writes a 401 or 403 response and returns
+// false if there is no session or the session lacks one of the given scopes.
+func userClient(w http.ResponseWriter, r *http.Request, scopes ...string) (*SpotifyClient, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		writeError(w, r, http.StatusUnauthorized, "Not logged in; authenticate via /spotify/login")
+		return nil, false
+	}
+	session, ok, err := tokens.Get(cookie.Value)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "Could not load session: "+err.Error())
+		return nil, false
+	}
+	if !ok {
+		writeError(w, r, http.StatusUnauthorized, "Session expired; authenticate via /spotify/login")
+		return nil, false
+	}
+
+	client := &SpotifyClient{
+		ClientID:     spotifyClient.ClientID,
+		ClientSecret: spotifyClient.ClientSecret,
+		AccessToken:  session.AccessToken,
+		ExpiresAt:    session.ExpiresAt,
+		HTTPClient:   spotifyClient.HTTPClient,
+		RefreshToken: session.RefreshToken,
+		Scope:        session.Scope,
+		sessionID:    cookie.Value,
+		MaxRetries:   spotifyClient.MaxRetries,
+		MaxRetryWait: spotifyClient.MaxRetryWait,
+		AuthRetries:  spotifyClient.AuthRetries,
+		AuthTimeout:  spotifyClient.AuthTimeout,
+		Breaker:      spotifyClient.Breaker,
+	}
+	for _, scope := range scopes {
+		if !client.hasScope(scope) {
+			writeScopeError(w, r, scope)
+			return nil, false
+		}
+	}
+	return client, true
+}
+
+func (c *SpotifyClient) hasScope(scope string) bool {
+	return containsString(strings.Fields(c.Scope), scope)
+}
+
+func writeScopeError(w http.ResponseWriter, r *http.Request, scope string) {
+	writeError(w, r, http.StatusForbidden, fmt.Sprintf("Missing required scope '%s'; log in again via /spotify/login?scope=%s", scope, scope))
+}
+
+// handleFollowingContains reports whether the logged-in user follows each of
+// the given artists or users.
+func handleFollowingContains(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	followType := v.oneOf(r, "type", "artist", "user")
+	ids := v.ids(r, followType, 50)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client, ok := userClient(w, r, "user-follow-read")
+	if !ok {
+		return
+	}
+
+	data, err := client.get(r.Context(), "/me/following/contains?type="+followType+"&ids="+strings.Join(ids, ","))
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	var result []bool
+	if err := decodeJSON(data, &result); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	following := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		following[id] = i < len(result) && result[i]
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"following": following,
+	})
+}
+
+// handleFollowing follows (PUT) or unfollows (DELETE) artists or users for
+// the logged-in user.
+func handleFollowing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use PUT to follow or DELETE to unfollow")
+		return
+	}
+
+	v := &validator{}
+	followType := v.oneOf(r, "type", "artist", "user")
+	ids := v.ids(r, followType, 50)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client, ok := userClient(w, r, "user-follow-modify")
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	if _, err := client.makeRequest(r.Context(), r.Method, "/me/following?type="+followType, bytes.NewReader(body), nil); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"following": r.Method == http.MethodPut,
+		"ids":       ids,
+	})
+}
+
+// handleCreatePlaylist creates a playlist owned by the logged-in user from a
+// JSON body of the form {"name": ..., "description": ..., "public": ...}.
+func handleCreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use POST to create a playlist")
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Public      *bool  `json:"public"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	v := &validator{}
+	if strings.TrimSpace(req.Name) == "" {
+		v.add("name", "name is required")
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	// Spotify creates public playlists unless told otherwise.
+	public := req.Public == nil || *req.Public
+	scope := "playlist-modify-public"
+	if !public {
+		scope = "playlist-modify-private"
+	}
+	client, ok := userClient(w, r, scope)
+	if !ok {
+		return
+	}
+
+	var me spotifyUser
+	if err := client.getJSON(r.Context(), "/me", &me); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":        req.Name,
+		"description": req.Description,
+		"public":      public,
+	})
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	data, err := client.makeRequest(r.Context(), "POST", "/users/"+url.PathEscape(me.ID)+"/playlists", bytes.NewReader(body), nil)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	var playlist spotifyPlaylist
+	if err := decodeJSON(data, &playlist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, PlaylistResponse{
+		Success:  true,
+		Playlist: getPlaylist(playlist),
+	})
+}
+
+// maxTracksPerRequest is the most items Spotify accepts in one add-tracks call.
+const maxTracksPerRequest = 100
+
+var itemURIPattern = regexp.MustCompile(`^spotify:(track|episode):[0-9A-Za-z]{22}$`)
+
+// handleAddTracks appends the track or episode URIs in a JSON body of the
+// form {"uris": [...]} to the playlist given by the "id" parameter, splitting
+// them into batches of maxTracksPerRequest.
+func handleAddTracks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use POST to add tracks")
+		return
+	}
+
+	v := &validator{}
+	playlistID := v.require(r, "id")
+
+	var req struct {
+		URIs []string `json:"uris"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.URIs) == 0 {
+		v.add("uris", "uris must contain at least one URI")
+	}
+	for i, uri := range req.URIs {
+		if !itemURIPattern.MatchString(uri) {
+			v.add(fmt.Sprintf("uris[%d]", i), "not a valid Spotify track or episode URI")
+		}
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client, ok := userClient(w, r)
+	if !ok {
+		return
+	}
+	if !client.hasScope("playlist-modify-public") && !client.hasScope("playlist-modify-private") {
+		writeScopeError(w, r, "playlist-modify-public")
+		return
+	}
+
+	var snapshotID string
+	for start := 0; start < len(req.URIs); start += maxTracksPerRequest {
+		end := start + maxTracksPerRequest
+		if end > len(req.URIs) {
+			end = len(req.URIs)
+		}
+
+		body, err := json.Marshal(map[string][]string{"uris": req.URIs[start:end]})
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+
+		data, err := client.makeRequest(r.Context(), "POST", "/playlists/"+url.PathEscape(playlistID)+"/tracks", bytes.NewReader(body), nil)
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+
+		var result struct {
+			SnapshotID string `json:"snapshot_id"`
+		}
+		if err := decodeJSON(data, &result); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		snapshotID = result.SnapshotID
+	}
+
+	writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"success":    true,
+		"snapshotId": snapshotID,
+		"added":      len(req.URIs),
+	})
+}
+
+// handlePlayerContext returns the logged-in user's current track together
+// with the playlist, album or artist it is playing from.
+func handlePlayerContext(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	market := v.userMarket(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client, ok := userClient(w, r, "user-read-currently-playing")
+	if !ok {
+		return
+	}
+
+	data, err := client.get(r.Context(), withMarket("/me/player/currently-playing", market))
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := PlayerContextResponse{Success: true}
+
+	// Spotify answers 204 with no body when nothing is playing.
+	if len(data) == 0 {
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	var playing spotifyCurrentlyPlaying
+	if err := decodeJSON(data, &playing); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response.Playing = playing.IsPlaying
+	if playing.Item != nil {
+		track := getTrackInfo(*playing.Item)
+		response.Track = &track
+	}
+	if playing.Context != nil {
+		response.Context = &PlayerContext{
+			Type: playing.Context.Type,
+			URI:  playing.Context.URI,
+			Name: contextName(r.Context(), client, playing.Context),
+			URL:  playing.Context.ExternalURLs.Spotify,
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handlePlaybackQueue returns the logged-in user's current track and the
+// upcoming items in their playback queue.
+func handlePlaybackQueue(w http.ResponseWriter, r *http.Request) {
+	client, ok := userClient(w, r, "user-read-playback-state")
+	if !ok {
+		return
+	}
+
+	var queue spotifyQueue
+	if err := client.getJSON(r.Context(), "/me/player/queue", &queue); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := QueueResponse{
+		Success: true,
+		Queue:   make([]TrackInfo, len(queue.Queue)),
+	}
+	if queue.CurrentlyPlaying != nil {
+		current := getTrackInfo(*queue.CurrentlyPlaying)
+		response.Current = &current
+	}
+	for i, track := range queue.Queue {
+		response.Queue[i] = getTrackInfo(track)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleSavedAlbums returns a page of the albums saved in the user's library.
+func handleSavedAlbums(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	offset := v.intRange(r, "offset", 0, 0, 10000)
+	market := v.userMarket(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client, ok := userClient(w, r, "user-library-read")
+	if !ok {
+		return
+	}
+
+	var page struct {
+		Items []struct {
+			AddedAt string       `json:"added_at"`
+			Album   spotifyAlbum `json:"album"`
+		} `json:"items"`
+		Total    int    `json:"total"`
+		Next     string `json:"next"`
+		Previous string `json:"previous"`
+	}
+	if err := client.getJSON(r.Context(), withMarket(fmt.Sprintf("/me/albums?limit=%d&offset=%d", limit, offset), market), &page); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := SavedAlbumsResponse{
+		Success:  true,
+		Albums:   make([]SavedAlbum, len(page.Items)),
+		Total:    page.Total,
+		Next:     page.Next,
+		Previous: page.Previous,
+	}
+	for i, item := range page.Items {
+		response.Albums[i] = SavedAlbum{
+			AddedAt:   item.AddedAt,
+			AlbumInfo: getAlbumInfo(item.Album),
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleDevices lists the logged-in user's available playback devices.
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	client, ok := userClient(w, r, "user-read-playback-state")
+	if !ok {
+		return
+	}
+
+	var result struct {
+		Devices []spotifyDevice `json:"devices"`
+	}
+	if err := client.getJSON(r.Context(), "/me/player/devices", &result); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := DevicesResponse{
+		Success: true,
+		Devices: make([]DeviceInfo, len(result.Devices)),
+	}
+	for i, d := range result.Devices {
+		response.Devices[i] = DeviceInfo{
+			ID:       d.ID,
+			Name:     d.Name,
+			Type:     d.Type,
+			IsActive: d.IsActive,
+			Volume:   d.VolumePercent,
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// playbackCommand returns a handler that sends a playback command such as
+// "pause" or "next" to the user's active device, or to the device given by
+// the optional device_id parameter.
+func playbackCommand(method, command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("Use %s to %s playback", method, command))
+			return
+		}
+
+		client, ok := userClient(w, r, "user-modify-playback-state")
+		if !ok {
+			return
+		}
+
+		endpoint := "/me/player/" + command
+		if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+			endpoint += "?device_id=" + url.QueryEscape(deviceID)
+		}
+
+		if _, err := client.makeRequest(r.Context(), method, endpoint, nil, nil); err != nil {
+			// Spotify answers 404 when there is no device to control.
+			if apiErr, ok := err.(*APIError); ok && apiErr.Status == http.StatusNotFound {
+				writeError(w, r, http.StatusNotFound, "No active device; open Spotify on a device or pass device_id")
+				return
+			}
+			writeUpstreamError(w, r, err)
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"command": command,
+		})
+	}
+}
+
+// handleRecommendations recommends tracks seeded from the logged-in user's
+// top five tracks.
+func handleRecommendations(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	timeRange := "medium_term"
+	if r.URL.Query().Get("time_range") != "" {
+		timeRange = v.oneOf(r, "time_range", "short_term", "medium_term", "long_term")
+	}
+	limit := v.intRange(r, "limit", 20, 1, 100)
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.userMarket(r)
+	dryRun := v.boolean(r, "dry_run", false)
+	params := v.seeds(r)
+	for field, values := range v.tunables(r) {
+		params[field] = values
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+	params.Set("limit", strconv.Itoa(limit))
+	if market != "" {
+		params.Set("market", market)
+	}
+
+	if dryRun {
+		response := RecommendationsDryRunResponse{
+			Success:    true,
+			Parameters: make(map[string]string, len(params)),
+		}
+		for field := range params {
+			response.Parameters[field] = params.Get(field)
+		}
+		writeJSON(w, r, http.StatusOK, response)
+		return
+	}
+
+	client, ok := userClient(w, r, "user-top-read")
+	if !ok {
+		return
+	}
+
+	if params.Get("seed_artists") == "" && params.Get("seed_genres") == "" && params.Get("seed_tracks") == "" {
+		var top spotifyTrackPage
+		if err := client.getJSON(r.Context(), fmt.Sprintf("/me/top/tracks?limit=%d&time_range=%s", maxRecommendationSeeds, timeRange), &top); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		if len(top.Items) == 0 {
+			writeNotFound(w, r, "No top tracks found to seed recommendations")
+			return
+		}
+		seeds := make([]string, len(top.Items))
+		for i, track := range top.Items {
+			seeds[i] = track.ID
+		}
+		params.Set("seed_tracks", strings.Join(seeds, ","))
+	}
+
+	var recommendations struct {
+		Tracks []spotifyTrack `json:"tracks"`
+	}
+	if err := client.getJSON(r.Context(), "/recommendations?"+params.Encode(), &recommendations); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := RecommendationsResponse{
+		Success:     true,
+		Seeds:       append([]string{}, splitList(params.Get("seed_tracks"))...),
+		Tracks:      make([]TrackInfo, len(recommendations.Tracks)),
+		SeedArtists: splitList(params.Get("seed_artists")),
+		SeedGenres:  splitList(params.Get("seed_genres")),
+	}
+	for i, track := range recommendations.Tracks {
+		response.Tracks[i] = getTrackInfo(track)
+		if withAlbum {
+			response.Tracks[i].Album = getTrackAlbum(track.Album)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// contextName looks up the name of a playback context. It is best effort:
+// some contexts, such as the user's Liked Songs collection, can't be fetched,
+// in which case the name is left empty.
+func contextName(ctx context.Context, client *SpotifyClient, playbackContext *spotifyContext) string {
+	endpoint, err := pagingEndpoint(playbackContext.Href)
+	if err != nil {
+		return ""
+	}
+	if playbackContext.Type == "playlist" {
+		sep := "?"
+		if strings.Contains(endpoint, "?") {
+			sep = "&"
+		}
+		endpoint += sep + "fields=name"
+	}
+
+	var result struct {
+		Name string `json:"name"`
+	}
+	if err := client.getJSON(ctx, endpoint, &result); err != nil {
+		return ""
+	}
+	return result.Name
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeJSON(w, r, status, map[string]interface{}{
+		"success": false,
+		"message": message,
+	})
+}
+
+// maxBodyBytes caps the size of JSON request bodies.
+var maxBodyBytes int64 = 1 << 20
+
+// decodeBody decodes the JSON request body into v, reading at most
+// maxBodyBytes. When it fails it writes 413 for an oversized body or 400 for
+// invalid JSON and returns false. The body is read to its end, so one that
+// only exceeds the limit after the JSON value is still rejected, as is data
+// after the value.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(v)
+	if err == nil {
+		if err = decoder.Decode(&json.RawMessage{}); err == io.EOF {
+			return true
+		}
+		if err == nil {
+			err = errors.New("unexpected data after the JSON value")
+		}
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must be at most %d bytes", maxBodyBytes))
+		return false
+	}
+	writeError(w, r, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+	return false
+}
+
+// MarketUnavailableError means an item exists but can't be played in the
+// requested market.
+type MarketUnavailableError struct {
+	Market string
+}
+
+func (e *MarketUnavailableError) Error() string {
+	return fmt.Sprintf("exists but not available in market %s", e.Market)
+}
+
+// getInMarket fetches a single catalog item into v. Spotify answers 404 both
+// for unknown items and for items unavailable in the requested market, so on
+// a 404 the item is fetched again without a market to tell the two apart.
+// If that fetch fails too, its error is returned: a 404 for an unknown item,
+// or whatever kept the item from being checked.
+func getInMarket(ctx context.Context, client *SpotifyClient, endpoint, market string, v interface{}) error {
+	err := client.getJSON(ctx, withMarket(endpoint, market), v)
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Status != http.StatusNotFound || market == "" {
+		return err
+	}
+	if _, err := client.get(ctx, endpoint); err != nil {
+		return err
+	}
+	return &MarketUnavailableError{Market: market}
+}
+
+// writeUpstreamError reports a failed Spotify call, keeping Spotify's client
+// error statuses and mapping its server errors to 502.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errCircuitOpen {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	// Without a token nothing can be fetched, whatever the request was.
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		writeError(w, r, http.StatusBadGateway, err.Error())
+		return
+	}
+	switch e := err.(type) {
+	case *NotFoundError:
+		writeNotFound(w, r, e.Error())
+	case *MarketUnavailableError:
+		writeError(w, r, http.StatusNotFound, e.Error())
+	case *RestrictedEndpointError:
+		writeError(w, r, http.StatusForbidden, e.Error())
+	case *APIError:
+		switch {
+		case e.Status == http.StatusNotFound:
+			writeError(w, r, http.StatusNotFound, "Not found")
+		case e.Status >= 500:
+			writeError(w, r, http.StatusBadGateway, e.Error())
+		default:
+			writeError(w, r, e.Status, e.Error())
+		}
+	default:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// writeNotFound reports a search without results. The legacy envelope has
+// always done this with a 200 status; v2 uses 404.
+func writeNotFound(w http.ResponseWriter, r *http.Request, message string) {
+	status := http.StatusOK
+	if useEnvelopeV2(r) {
+		status = http.StatusNotFound
+	}
+	writeError(w, r, status, message)
+}
+
+// Envelope is the v2 response shape, selected with ?envelope=v2. Every
+// response has "success"; successful ones carry their payload in "data" and
+// failed ones describe the problem in "error".
+type Envelope struct {
+	Success bool           `json:"success"`
+	Data    interface{}    `json:"data,omitempty"`
+	Error   *EnvelopeError `json:"error,omitempty"`
+	Meta    EnvelopeMeta   `json:"meta"`
+}
+
+// EnvelopeMeta describes the server that produced a v2 response and where
+// its data came from (see dataSource).
+type EnvelopeMeta struct {
+	Version string `json:"version"`
+	Source  string `json:"source,omitempty"`
+}
+
+type EnvelopeError struct {
+	Message string            `json:"message"`
+	Details []ValidationError `json:"details,omitempty"`
+}
+
+func useEnvelopeV2(r *http.Request) bool {
+	return r.URL.Query().Get("envelope") == "v2"
+}
+
+// writeJSON writes v with the given status. Handlers always build the legacy
+// {"success": ..., "<object>": ...} shape; for v2 requests it is converted by
+// toEnvelope.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if format := r.URL.Query().Get("duration_format"); format != "" {
+		if formatted, err := withDurationFormat(v, format); err == nil {
+			v = formatted
+		}
+	}
+	if useEnvelopeV2(r) {
+		envelope, err := toEnvelope(v)
+		if err != nil {
+			status = http.StatusInternalServerError
+			envelope = Envelope{Error: &EnvelopeError{Message: err.Error()}}
+		}
+		envelope.Meta.Version = version
+		envelope.Meta.Source = dataSource(r.Context())
+		v = envelope
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if servedStale(r.Context()) {
+		w.Header().Set("X-Cache", "STALE")
+	}
+	if source := dataSource(r.Context()); source != "" {
+		w.Header().Set("X-Data-Source", source)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// durationFormats are the values of the duration_format parameter.
+var durationFormats = []string{"ms", "clock", "iso8601"}
+
+// withDurationFormat rewrites the durations in a response for the
+// duration_format parameter. Every object with a duration_ms, or an album
+// track with only a duration in milliseconds, gets a "duration" in the given
+// format and keeps or gains "duration_ms".
+func withDurationFormat(v interface{}, format string) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	formatDurations(doc, format)
+	return doc, nil
+}
+
+func formatDurations(doc interface{}, format string) {
+	switch node := doc.(type) {
+	case []interface{}:
+		for _, item := range node {
+			formatDurations(item, format)
+		}
+	case map[string]interface{}:
+		ms, ok := node["duration_ms"].(json.Number)
+		if !ok {
+			// Album tracks (TrackBasic) carry milliseconds in "duration".
+			if _, isTrack := node["trackNumber"]; isTrack {
+				ms, ok = node["duration"].(json.Number)
+			}
+		}
+		if n, err := ms.Int64(); ok && err == nil {
+			node["duration_ms"] = ms
+			switch format {
+			case "ms":
+				node["duration"] = ms
+			case "clock":
+				node["duration"] = formatClockDuration(int(n))
+			case "iso8601":
+				node["duration"] = formatISODuration(int(n))
+			}
+		}
+		for _, value := range node {
+			formatDurations(value, format)
+		}
+	}
+}
+
+// durationFormatHandler rejects requests with an unknown duration_format
+// before they reach the endpoint.
+func durationFormatHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if format := r.URL.Query().Get("duration_format"); format != "" && !containsString(durationFormats, format) {
+			v := &validator{}
+			v.add("duration_format", fmt.Sprintf("duration_format must be one of: %s", strings.Join(durationFormats, ", ")))
+			v.writeError(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// toEnvelope converts a legacy response into an Envelope. "message" and
+// "details" become the error; the remaining fields become the data, unwrapped
+// when there is only one of them.
+func toEnvelope(v interface{}) (Envelope, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return Envelope{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return Envelope{}, err
+	}
+
+	var envelope Envelope
+	json.Unmarshal(fields["success"], &envelope.Success)
+	delete(fields, "success")
+
+	if !envelope.Success {
+		envelope.Error = &EnvelopeError{}
+		json.Unmarshal(fields["message"], &envelope.Error.Message)
+		json.Unmarshal(fields["details"], &envelope.Error.Details)
+		delete(fields, "message")
+		delete(fields, "details")
+	}
+
+	switch len(fields) {
+	case 0:
+	case 1:
+		for _, value := range fields {
+			envelope.Data = value
+		}
+	default:
+		envelope.Data = fields
+	}
+	return envelope, nil
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validator collects every invalid parameter of a request so that all of
+// them can be reported in a single 400 response.
+type validator struct {
+	errors []ValidationError
+}
+
+var marketPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+func (v *validator) add(field, message string) {
+	v.errors = append(v.errors, ValidationError{Field: field, Message: message})
+}
+
+func (v *validator) valid() bool {
+	return len(v.errors) == 0
+}
+
+func (v *validator) require(r *http.Request, field string) string {
+	value := r.URL.Query().Get(field)
+	if value == "" {
+		v.add(field, fmt.Sprintf("Missing query parameter '%s'", field))
+	}
+	return value
+}
+
+// Length limits for parameters that end up in Spotify URLs. They keep those
+// URLs far below the roughly 8 KB that Spotify and proxies accept, so
+// over-long input gets a clear 400 instead of an opaque upstream error.
+const (
+	// maxSearchLength caps search text, in bytes. Escaping can triple it.
+	maxSearchLength = 500
+	// maxIDLength caps an id and each entry of an ids list. Spotify IDs
+	// have 22 characters; user IDs can be longer.
+	maxIDLength = 64
+)
+
+// searchText returns the required search text parameter field, which may be
+// at most maxSearchLength bytes long.
+func (v *validator) searchText(r *http.Request, field string) string {
+	value := v.require(r, field)
+	if len(value) > maxSearchLength {
+		v.add(field, fmt.Sprintf("%s must be at most %d characters", field, maxSearchLength))
+	}
+	return value
+}
+
+// market returns the optional ISO 3166-1 alpha-2 market code, upper-cased.
+// Without a "market" parameter it falls back to the Accept-Language header
+// (when -market-from-language is set) and then to -default-market.
+func (v *validator) market(r *http.Request) string {
+	market := strings.ToUpper(r.URL.Query().Get("market"))
+	if strings.EqualFold(market, marketFromToken) {
+		v.add("market", "market=from_token needs a user token, which only the /spotify/me/ endpoints use")
+		return ""
+	}
+	if market != "" && !marketPattern.MatchString(market) {
+		v.add("market", "market must be a two-letter ISO 3166-1 country code")
+	}
+	if market == "" && marketFromLanguage {
+		market = languageMarket(r.Header.Get("Accept-Language"))
+	}
+	if market == "" {
+		market = defaultMarket
+	}
+	return market
+}
+
+// marketFromToken asks Spotify to use the market of the user's account. It
+// only works with user tokens: client credentials have no market.
+const marketFromToken = "from_token"
+
+// userMarketFromToken makes the /spotify/me/ endpoints use the user's own
+// market when a request names none, instead of the fallbacks of market.
+var userMarketFromToken = false
+
+// userMarket is market for endpoints that call Spotify with the logged-in
+// user's token, which also accept market=from_token.
+func (v *validator) userMarket(r *http.Request) string {
+	if raw := r.URL.Query().Get("market"); strings.EqualFold(raw, marketFromToken) || raw == "" && userMarketFromToken {
+		return marketFromToken
+	}
+	return v.market(r)
+}
+
+// languageMarkets maps languages that are mostly spoken in one market to
+// that market, for Accept-Language values without a region such as "de".
+var languageMarkets = map[string]string{
+	"cs": "CZ",
+	"da": "DK",
+	"de": "DE",
+	"el": "GR",
+	"fi": "FI",
+	"fr": "FR",
+	"he": "IL",
+	"hu": "HU",
+	"id": "ID",
+	"it": "IT",
+	"ja": "JP",
+	"ko": "KR",
+	"nb": "NO",
+	"nl": "NL",
+	"pl": "PL",
+	"ro": "RO",
+	"sv": "SE",
+	"th": "TH",
+	"tr": "TR",
+	"uk": "UA",
+	"vi": "VN",
+}
+
+// languageMarket picks a market from an Accept-Language header. Languages
+// are tried in order of preference; the first one with a region subtag
+// ("de-DE" -> DE) or listed in languageMarkets ("de" -> DE) wins.
+func languageMarket(header string) string {
+	type language struct {
+		tag string
+		q   float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		l := language{tag: strings.TrimSpace(fields[0]), q: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					l.q = q
+				}
+			}
+		}
+		if l.tag != "" && l.tag != "*" && l.q > 0 {
+			languages = append(languages, l)
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].q > languages[j].q })
+
+	for _, l := range languages {
+		subtags := strings.Split(l.tag, "-")
+		for _, subtag := range subtags[1:] {
+			if region := strings.ToUpper(subtag); marketPattern.MatchString(region) {
+				return region
+			}
+		}
+		if market, ok := languageMarkets[strings.ToLower(subtags[0])]; ok {
+			return market
+		}
+	}
+	return ""
+}
+
+func (v *validator) intRange(r *http.Request, field string, def, min, max int) int {
+	raw := r.URL.Query().Get(field)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		v.add(field, field+" must be an integer")
+		return def
+	}
+	if n < min || n > max {
+		v.add(field, fmt.Sprintf("%s must be between %d and %d", field, min, max))
+		return def
+	}
+	return n
+}
+
+func (v *validator) floatRange(r *http.Request, field string, def, min, max float64) float64 {
+	raw := r.URL.Query().Get(field)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		v.add(field, field+" must be a number")
+		return def
+	}
+	if n < min || n > max {
+		v.add(field, fmt.Sprintf("%s must be between %g and %g", field, min, max))
+		return def
+	}
+	return n
+}
+
+func (v *validator) boolean(r *http.Request, field string, def bool) bool {
+	raw := r.URL.Query().Get(field)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		v.add(field, field+" must be true or false")
+		return def
+	}
+	return b
+}
+
+// artistQuery returns the required "q" parameter of an artist endpoint,
+// reduced to its primary artist by primaryArtist when normalize=true.
+func (v *validator) artistQuery(r *http.Request) string {
+	query := v.searchText(r, "q")
+	if v.boolean(r, "normalize", false) {
+		query = primaryArtist(query)
+	}
+	return query
+}
+
+// collabSuffix matches a featured artist or collaborator and everything after
+// it: "feat.", "ft." or "featuring", optionally in parentheses or brackets,
+// or " & " or " x " between two names.
+var collabSuffix = regexp.MustCompile(`(?i)\s*[(\[]?\s*\b(?:feat\.?|ft\.?|featuring)(?:\s.*)?$|\s+(?:&|x|×)\s.*$`)
+
+// primaryArtist strips collaborators from an artist query, so "Drake ft.
+// Future" searches for Drake. A query that would be left empty is kept.
+func primaryArtist(query string) string {
+	if stripped := strings.TrimSpace(collabSuffix.ReplaceAllString(query, "")); stripped != "" {
+		return stripped
+	}
+	return query
+}
+
+// oneOf returns the required parameter field, which must be one of values.
+func (v *validator) oneOf(r *http.Request, field string, values ...string) string {
+	value := v.require(r, field)
+	if value != "" && !containsString(values, value) {
+		v.add(field, fmt.Sprintf("%s must be one of: %s", field, strings.Join(values, ", ")))
+	}
+	return value
+}
+
+// searchTypes returns the required comma-separated "type" parameter, each of
+// which must be a Spotify search type.
+func (v *validator) searchTypes(r *http.Request) []string {
+	raw := v.require(r, "type")
+	if raw == "" {
+		return nil
+	}
+	types := strings.Split(raw, ",")
+	for _, t := range types {
+		if !containsString(searchTypes, t) {
+			v.add("type", fmt.Sprintf("type must be a comma-separated list of: %s", strings.Join(searchTypes, ", ")))
+			break
+		}
+	}
+	return types
+}
+
+var searchTypes = []string{"album", "artist", "playlist", "track", "show", "episode", "audiobook"}
+
+// ids returns the required comma-separated "ids" parameter, allowing at most
+// max entries. Entries may be Spotify URIs or share links as well as ids;
+// normalizeID reduces them to ids of the given kind.
+func (v *validator) ids(r *http.Request, kind string, max int) []string {
+	raw := v.require(r, "ids")
+	if raw == "" {
+		return nil
+	}
+	ids := strings.Split(raw, ",")
+	if len(ids) > max {
+		v.add("ids", fmt.Sprintf("at most %d ids are allowed", max))
+	}
+	for i, entry := range ids {
+		if entry == "" {
+			v.add("ids", "ids must not contain empty entries")
+			break
+		}
+		id, err := normalizeID(entry, kind)
+		if err != nil {
+			v.add("ids", fmt.Sprintf("invalid entry %q: %v", entry, err))
+			break
+		}
+		if len(id) > maxIDLength {
+			v.add("ids", fmt.Sprintf("each id must be at most %d characters", maxIDLength))
+			break
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+// id returns the optional id parameter, normalized like each entry of ids so
+// a URI or share link works too. It returns "" only when the parameter is
+// absent, so an invalid id isn't also reported as a missing q.
+func (v *validator) id(r *http.Request, kind string) string {
+	raw := r.URL.Query().Get("id")
+	if raw == "" {
+		return ""
+	}
+	id, err := normalizeID(raw, kind)
+	if err != nil {
+		v.add("id", fmt.Sprintf("invalid id %q: %v", raw, err))
+		return raw
+	}
+	if len(id) > maxIDLength {
+		v.add("id", fmt.Sprintf("id must be at most %d characters", maxIDLength))
+	}
+	return id
+}
+
+// maxRecommendationSeeds is the most seeds /recommendations accepts, across
+// artists, genres and tracks.
+const maxRecommendationSeeds = 5
+
+// recommendationSeedFields are the seed parameters of /recommendations.
+var recommendationSeedFields = []string{"seed_artists", "seed_genres", "seed_tracks"}
+
+// seeds returns the optional comma-separated seed_artists, seed_genres and
+// seed_tracks parameters, which together may name at most
+// maxRecommendationSeeds seeds.
+func (v *validator) seeds(r *http.Request) url.Values {
+	params := url.Values{}
+	total := 0
+	for _, field := range recommendationSeedFields {
+		raw := r.URL.Query().Get(field)
+		if raw == "" {
+			continue
+		}
+		seeds := strings.Split(raw, ",")
+		for _, seed := range seeds {
+			if seed == "" {
+				v.add(field, field+" must not contain empty entries")
+				break
+			}
+			if len(seed) > maxIDLength {
+				v.add(field, fmt.Sprintf("each entry of %s must be at most %d characters", field, maxIDLength))
+				break
+			}
+		}
+		total += len(seeds)
+		params.Set(field, raw)
+	}
+	if total > maxRecommendationSeeds {
+		v.add("seeds", fmt.Sprintf("at most %d seeds are allowed across %s", maxRecommendationSeeds, strings.Join(recommendationSeedFields, ", ")))
+	}
+	return params
+}
+
+// recommendationTunable is a track attribute /recommendations can be tuned
+// by, with min_, max_ and target_ parameters between min and max.
+type recommendationTunable struct {
+	name     string
+	min, max float64
+	integer  bool
+}
+
+// recommendationTunables lists Spotify's tunable attributes and their
+// ranges. Spotify gives no upper bound for duration_ms and tempo; these are
+// generous ones.
+var recommendationTunables = []recommendationTunable{
+	{name: "acousticness", max: 1},
+	{name: "danceability", max: 1},
+	{name: "duration_ms", max: 24 * 60 * 60 * 1000, integer: true},
+	{name: "energy", max: 1},
+	{name: "instrumentalness", max: 1},
+	{name: "key", max: 11, integer: true},
+	{name: "liveness", max: 1},
+	{name: "loudness", min: -60, max: 0},
+	{name: "mode", max: 1, integer: true},
+	{name: "popularity", max: 100, integer: true},
+	{name: "speechiness", max: 1},
+	{name: "tempo", max: 300},
+	{name: "time_signature", min: 3, max: 7, integer: true},
+	{name: "valence", max: 1},
+}
+
+// tunables returns the min_, max_ and target_ parameters of
+// recommendationTunables given in the request. Each must be within the
+// attribute's range, and those of one attribute must be ordered
+// min <= target <= max.
+func (v *validator) tunables(r *http.Request) url.Values {
+	params := url.Values{}
+	for _, tunable := range recommendationTunables {
+		given := make(map[string]float64)
+		for _, prefix := range []string{"min", "target", "max"} {
+			field := prefix + "_" + tunable.name
+			if r.URL.Query().Get(field) == "" {
+				continue
+			}
+			invalid := len(v.errors)
+			var n float64
+			if tunable.integer {
+				n = float64(v.intRange(r, field, 0, int(tunable.min), int(tunable.max)))
+			} else {
+				n = v.floatRange(r, field, 0, tunable.min, tunable.max)
+			}
+			if len(v.errors) > invalid {
+				continue
+			}
+			given[prefix] = n
+			params.Set(field, strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+		min, hasMin := given["min"]
+		max, hasMax := given["max"]
+		target, hasTarget := given["target"]
+		switch {
+		case hasMin && hasMax && min > max:
+			v.add("min_"+tunable.name, fmt.Sprintf("min_%s must not be greater than max_%[1]s", tunable.name))
+		case hasTarget && hasMin && target < min:
+			v.add("target_"+tunable.name, fmt.Sprintf("target_%s must not be less than min_%[1]s", tunable.name))
+		case hasTarget && hasMax && target > max:
+			v.add("target_"+tunable.name, fmt.Sprintf("target_%s must not be greater than max_%[1]s", tunable.name))
+		}
+	}
+	return params
+}
+
+// splitList splits a comma-separated list, returning nil for an empty one.
+func splitList(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// markets parses the required comma-separated "markets" parameter.
+func (v *validator) markets(r *http.Request, max int) []string {
+	raw := v.require(r, "markets")
+	if raw == "" {
+		return nil
+	}
+	markets := strings.Split(strings.ToUpper(raw), ",")
+	if len(markets) > max {
+		v.add("markets", fmt.Sprintf("at most %d markets are allowed", max))
+	}
+	for _, market := range markets {
+		if !marketPattern.MatchString(market) {
+			v.add("markets", "each market must be a two-letter ISO 3166-1 country code")
+			break
+		}
+	}
+	return markets
+}
+
+func (v *validator) writeError(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusBadRequest, ValidationErrorResponse{
+		Success: false,
+		Message: "Invalid request parameters",
+		Details: v.errors,
+	})
+}
+
+func withMarket(endpoint, market string) string {
+	if market == "" {
+		return endpoint
+	}
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+	return endpoint + sep + "market=" + market
+}
+
+func albumsEndpoint(artistID string, limit, offset int) string {
+	return fmt.Sprintf("/artists/%s/albums?limit=%d&offset=%d", artistID, limit, offset)
+}
+
+// handleSimilarTracks recommends tracks whose audio features are within
+// tolerance of a seed track's. The seed is given by id or found by q.
+func handleSimilarTracks(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.id(r, "track")
+	var query string
+	if id == "" {
+		query = v.searchText(r, "q")
+	}
+	tolerance := v.floatRange(r, "tolerance", 0.1, 0.01, 1)
+	limit := v.intRange(r, "limit", 20, 1, 100)
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var score *float64
+	if id == "" {
+		var track spotifyTrack
+		if err := searchFirst(r.Context(), client, query, "track", market, &track); err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		id = track.ID
+		score = matchScore(query, withArtists(track.Name, track.Artists)...)
+	}
+
+	var features spotifyAudioFeatures
+	if err := client.getJSON(r.Context(), "/audio-features/"+url.PathEscape(id), &features); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("seed_tracks", id)
+	params.Set("limit", strconv.Itoa(limit))
+	setFeatureRange(params, "acousticness", features.Acousticness, tolerance, 0, 1)
+	setFeatureRange(params, "danceability", features.Danceability, tolerance, 0, 1)
+	setFeatureRange(params, "energy", features.Energy, tolerance, 0, 1)
+	setFeatureRange(params, "valence", features.Valence, tolerance, 0, 1)
+	// Tempo is in BPM, so the tolerance is relative to it.
+	setFeatureRange(params, "tempo", features.Tempo, features.Tempo*tolerance, 0, 1000)
+
+	var recommendations struct {
+		Tracks []spotifyTrack `json:"tracks"`
+	}
+	if err := client.getJSON(r.Context(), withMarket("/recommendations?"+params.Encode(), market), &recommendations); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := SimilarTracksResponse{
+		Success:    true,
+		Seed:       id,
+		MatchScore: score,
+		Tracks:     make([]TrackInfo, len(recommendations.Tracks)),
+	}
+	for i, track := range recommendations.Tracks {
+		response.Tracks[i] = getTrackInfo(track)
+		if withAlbum {
+			response.Tracks[i].Album = getTrackAlbum(track.Album)
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// setFeatureRange asks /recommendations for tracks whose feature is within
+// tolerance of value, clamped to [lo, hi].
+func setFeatureRange(params url.Values, feature string, value, tolerance, lo, hi float64) {
+	params.Set("target_"+feature, strconv.FormatFloat(value, 'f', -1, 64))
+	params.Set("min_"+feature, strconv.FormatFloat(math.Max(lo, value-tolerance), 'f', -1, 64))
+	params.Set("max_"+feature, strconv.FormatFloat(math.Min(hi, value+tolerance), 'f', -1, 64))
+}
+
+// handleTrackMarkets reports which of the given markets a track is
+// available in. available_markets only lists the markets of the track
+// itself, so each other market is looked up again to see whether Spotify
+// relinks the track to a playable copy there.
+func handleTrackMarkets(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.require(r, "id")
+	markets := v.markets(r, 50)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var track spotifyTrack
+	if err := client.getJSON(r.Context(), "/tracks/"+url.PathEscape(id), &track); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := TrackMarketsResponse{
+		Success:  true,
+		ID:       track.ID,
+		Markets:  make(map[string]bool, len(markets)),
+		Relinked: make(map[string]string),
+	}
+	var mu sync.Mutex
+	var failures subCallFailures
+	var tasks []func(ctx context.Context) error
+	for _, market := range markets {
+		market := market
+		if containsString(track.AvailableMarkets, market) {
+			response.Markets[market] = true
+			continue
+		}
+		response.Markets[market] = false
+		tasks = append(tasks, func(ctx context.Context) error {
+			var relinked spotifyTrack
+			if err := client.getJSON(ctx, withMarket("/tracks/"+url.PathEscape(id), market), &relinked); err != nil {
+				failures.add(market, err)
+				return nil
+			}
+			if relinked.IsPlayable == nil || !*relinked.IsPlayable {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			response.Markets[market] = true
+			if relinked.LinkedFrom != nil && relinked.ID != track.ID {
+				response.Relinked[market] = relinked.ID
+			}
+			return nil
+		})
+	}
+	runParallel(r.Context(), tasks...)
+	response.Partial = len(failures.warnings) > 0
+	response.Warnings = failures.warnings
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handleTracks looks up to 50 tracks in one call. Spotify answers unknown
+// IDs with null entries, which become placeholders at the same index.
+func handleTracks(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	ids := v.ids(r, "track", maxTrackIDsPerRequest)
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var result struct {
+		Tracks []*spotifyTrack `json:"tracks"`
+	}
+	if err := client.getJSON(r.Context(), withMarket("/tracks?ids="+strings.Join(ids, ","), market), &result); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	tracks := make([]BatchTrack, len(ids))
+	for i, id := range ids {
+		tracks[i].ID = id
+		if i < len(result.Tracks) && result.Tracks[i] != nil {
+			info := getTrackInfo(*result.Tracks[i])
+			if withAlbum {
+				info.Album = getTrackAlbum(result.Tracks[i].Album)
+			}
+			tracks[i].Found = true
+			tracks[i].TrackInfo = &info
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, TracksResponse{
+		Success: true,
+		Tracks:  tracks,
+	})
+}
+
+// maxTopTrackArtists is the most artists /spotify/artists/top-tracks takes,
+// as each costs a Spotify call.
+const maxTopTrackArtists = 20
+
+// handleArtistsTopTracks merges the top tracks of several artists, fetched
+// concurrently, into one list ranked by popularity. per_artist caps how many
+// of each artist's top tracks are used. A track that is a top track of
+// several of the artists is listed once.
+func handleArtistsTopTracks(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	ids := v.ids(r, "artist", maxTopTrackArtists)
+	perArtist := v.intRange(r, "per_artist", 10, 1, 10)
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	// Top tracks require a market, so fall back to US when none is given.
+	if market == "" {
+		market = "US"
+	}
+
+	client := spotifyClient
+
+	topTracks := make([][]spotifyTrack, len(ids))
+	var failures subCallFailures
+	tasks := make([]func(ctx context.Context) error, len(ids))
+	for i, id := range ids {
+		i, id := i, id
+		tasks[i] = func(ctx context.Context) error {
+			var result struct {
+				Tracks []spotifyTrack `json:"tracks"`
+			}
+			if err := client.getJSON(ctx, withMarket("/artists/"+url.PathEscape(id)+"/top-tracks", market), &result); err != nil {
+				failures.add("artist "+id, err)
+				return nil
+			}
+			if len(result.Tracks) > perArtist {
+				result.Tracks = result.Tracks[:perArtist]
+			}
+			topTracks[i] = result.Tracks
+			return nil
+		}
+	}
+	ctx, cancel := budgetContext(r)
+	defer cancel()
+	runParallel(ctx, tasks...)
+	if failures.all(len(ids)) {
+		writeBudgetedError(w, r, ctx, failures.first)
+		return
+	}
+
+	response := ArtistsTopTracksResponse{
+		Success:  true,
+		Tracks:   []ArtistTopTrack{},
+		Partial:  len(failures.warnings) > 0,
+		Warnings: failures.warnings,
+		Complete: budgetComplete(ctx),
+	}
+	index := make(map[string]int)
+	for i, tracks := range topTracks {
+		for _, track := range tracks {
+			if j, ok := index[track.ID]; ok {
+				response.Tracks[j].TopTrackOf = append(response.Tracks[j].TopTrackOf, ids[i])
+				continue
+			}
+			info := getTrackInfo(track)
+			if withAlbum {
+				info.Album = getTrackAlbum(track.Album)
+			}
+			index[track.ID] = len(response.Tracks)
+			response.Tracks = append(response.Tracks, ArtistTopTrack{TrackInfo: info, TopTrackOf: []string{ids[i]}})
+		}
+	}
+	sort.SliceStable(response.Tracks, func(i, j int) bool {
+		return response.Tracks[i].Popularity > response.Tracks[j].Popularity
+	})
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// maxISRCsPerRequest caps /spotify/tracks/isrc, which searches once per ISRC.
+const maxISRCsPerRequest = 50
+
+// isrcPattern matches an ISRC without hyphens: country, registrant, year
+// and designation code.
+var isrcPattern = regexp.MustCompile(`^[A-Z]{2}[A-Z0-9]{3}[0-9]{7}$`)
+
+// handleISRCTracks finds the Spotify track for each of a list of ISRCs,
+// searching for them concurrently. An ISRC often matches several tracks,
+// the same recording on a single and an album; the most popular is used.
+func handleISRCTracks(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	raw := v.require(r, "isrcs")
+	withAlbum := v.boolean(r, "album", trackAlbums)
+	market := v.market(r)
+	var isrcs []string
+	if raw != "" {
+		isrcs = strings.Split(strings.ToUpper(strings.Replace(raw, "-", "", -1)), ",")
+	}
+	if len(isrcs) > maxISRCsPerRequest {
+		v.add("isrcs", fmt.Sprintf("at most %d ISRCs are allowed", maxISRCsPerRequest))
+	}
+	for _, isrc := range isrcs {
+		if !isrcPattern.MatchString(isrc) {
+			v.add("isrcs", "each ISRC must be 12 characters such as USUG11904206, with or without hyphens")
+			break
+		}
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var failures subCallFailures
+	tracks := make([]ISRCTrack, len(isrcs))
+	tasks := make([]func(ctx context.Context) error, len(isrcs))
+	for i, isrc := range isrcs {
+		i, isrc := i, isrc
+		tracks[i].ISRC = isrc
+		tasks[i] = func(ctx context.Context) error {
+			var result struct {
+				Tracks spotifyTrackPage `json:"tracks"`
+			}
+			if err := client.getJSON(ctx, withMarket("/search?type=track&limit=10&q="+url.QueryEscape("isrc:"+isrc), market), &result); err != nil {
+				failures.add(isrc, err)
+				return nil
+			}
+			var best *spotifyTrack
+			for j, track := range result.Tracks.Items {
+				if !strings.EqualFold(track.ExternalIDs["isrc"], isrc) {
+					continue
+				}
+				if best == nil || track.Popularity > best.Popularity {
+					best = &result.Tracks.Items[j]
+				}
+			}
+			if best != nil {
+				info := getTrackInfo(*best)
+				if withAlbum {
+					info.Album = getTrackAlbum(best.Album)
+				}
+				tracks[i].Found = true
+				tracks[i].TrackInfo = &info
+			}
+			return nil
+		}
+	}
+	runParallel(r.Context(), tasks...)
+	if failures.all(len(tasks)) {
+		writeUpstreamError(w, r, failures.first)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, ISRCTracksResponse{
+		Success:  true,
+		Tracks:   tracks,
+		Partial:  len(failures.warnings) > 0,
+		Warnings: failures.warnings,
+	})
+}
+
+// handleEpisodes looks up to 50 podcast episodes in one call.
+func handleEpisodes(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	ids := v.ids(r, "episode", 50)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var result struct {
+		Episodes []*spotifyEpisode `json:"episodes"`
+	}
+	if err := client.getJSON(r.Context(), withMarket("/episodes?ids="+strings.Join(ids, ","), market), &result); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	episodes := make([]*EpisodeInfo, len(ids))
+	for i, episode := range result.Episodes {
+		if i < len(episodes) && episode != nil {
+			info := getEpisodeInfo(*episode)
+			episodes[i] = &info
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, EpisodesResponse{
+		Success:  true,
+		Episodes: episodes,
+	})
+}
+
+// handleAudiobookChapters returns a page of an audiobook's chapters. Long
+// books have hundreds, so they are read limit at a time; the page's next
+// URL can be followed with /spotify/page. Audiobooks are only sold in some
+// markets, so an audiobook unavailable in market gets a 404 saying so.
+func handleAudiobookChapters(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	id := v.require(r, "id")
+	limit := v.intRange(r, "limit", 20, 1, 50)
+	offset := v.intRange(r, "offset", 0, 0, 10000)
+	market := v.market(r)
+	prefetch := v.boolean(r, "prefetch", false)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	var page spotifyChapterPage
+	endpoint := fmt.Sprintf("/audiobooks/%s/chapters?limit=%d&offset=%d", url.PathEscape(id), limit, offset)
+	if err := getInMarket(r.Context(), spotifyClient, endpoint, market, &page); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	if prefetch {
+		prefetchPage(spotifyClient, page.Next)
+	}
+
+	writeJSON(w, r, http.StatusOK, AudiobookChaptersResponse{
+		Success:  true,
+		ID:       id,
+		Chapters: getChapters(page.Items),
+		Total:    page.Total,
+		Next:     page.Next,
+		Previous: page.Previous,
+	})
+}
+
+// handleShows looks up to 50 podcast shows in one call.
+func handleShows(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	ids := v.ids(r, "show", 50)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var result struct {
+		Shows []*spotifyShow `json:"shows"`
+	}
+	if err := client.getJSON(r.Context(), withMarket("/shows?ids="+strings.Join(ids, ","), market), &result); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	shows := make([]*ShowInfo, len(ids))
+	for i, show := range result.Shows {
+		if i < len(shows) && show != nil {
+			info := getShowInfo(*show)
+			shows[i] = &info
+		}
+	}
+
+	writeJSON(w, r, http.StatusOK, ShowsResponse{
+		Success: true,
+		Shows:   shows,
+	})
+}
+
+var (
+	// intlPathPrefix is the locale segment of localized share links, as in
+	// open.spotify.com/intl-de/track/ID or /intl-pt-BR/.
+	intlPathPrefix   = regexp.MustCompile(`^intl-[a-zA-Z]{2}([-_][a-zA-Z]{2})?$`)
+	spotifyIDPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+)
+
+// shareLinkTypes are the item types a share link can point to.
+var shareLinkTypes = map[string]bool{
+	"track": true, "album": true, "artist": true,
+	"playlist": true, "show": true, "episode": true,
+}
+
+// parseShareLink extracts the item type and id from a Spotify share link or
+// URI. Query strings such as ?si=... and fragments are ignored, as are
+// locale segments, and the legacy /user/USER/playlist/ID form is accepted.
+// Links may be pasted without a scheme.
+func parseShareLink(raw string) (kind, id string, ok bool) {
+	raw = strings.TrimSpace(raw)
+	var parts []string
+	if strings.HasPrefix(raw, "spotify:") {
+		parts = strings.Split(strings.TrimPrefix(raw, "spotify:"), ":")
+	} else {
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			return "", "", false
+		}
+		if host := u.Hostname(); host != "open.spotify.com" && host != "play.spotify.com" {
+			return "", "", false
+		}
+		for _, part := range strings.Split(u.Path, "/") {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 && intlPathPrefix.MatchString(parts[0]) {
+			parts = parts[1:]
+		}
+	}
+
+	if len(parts) == 4 && parts[0] == "user" && parts[2] == "playlist" {
+		parts = parts[2:]
+	}
+	if len(parts) != 2 || !shareLinkTypes[parts[0]] || !spotifyIDPattern.MatchString(parts[1]) {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// errInvalidShareLink is reported for links parseShareLink rejects.
+var errInvalidShareLink = errors.New("not a Spotify link or URI for a track, album, artist, playlist, show or episode")
+
+// handleResolve looks up the item behind a share link given by the "url"
+// parameter and returns it with the link's clean form.
+func handleResolve(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	link := v.require(r, "url")
+	market := v.market(r)
+	if _, _, ok := parseShareLink(link); link != "" && !ok {
+		v.add("url", "url must be a Spotify link or URI for a track, album, artist, playlist, show or episode")
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	resolved, err := resolveLink(r.Context(), spotifyClient, link, market)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, ResolveResponse{
+		Success:      true,
+		ResolvedLink: resolved,
+	})
+}
+
+// maxLinksPerBatch caps the links in one /spotify/resolve/batch request.
+const maxLinksPerBatch = 50
+
+// handleResolveBatch resolves the links in a JSON body of the form
+// {"urls": [...]}, at most maxConcurrency at a time. A link that fails
+// doesn't fail the others.
+func handleResolveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use POST to resolve links")
+		return
+	}
+
+	v := &validator{}
+	market := v.market(r)
+
+	var req struct {
+		URLs []string `json:"urls"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.URLs) == 0 {
+		v.add("urls", "urls must contain at least one link")
+	}
+	if len(req.URLs) > maxLinksPerBatch {
+		v.add("urls", fmt.Sprintf("at most %d links are allowed", maxLinksPerBatch))
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	results := make([]BatchResolved, len(req.URLs))
+	tasks := make([]func(ctx context.Context) error, len(req.URLs))
+	for i, link := range req.URLs {
+		i, link := i, link
+		results[i].Input = link
+		tasks[i] = func(ctx context.Context) error {
+			resolved, err := resolveLink(ctx, client, link, market)
+			if err != nil {
+				results[i].Error = err.Error()
+				return nil
+			}
+			results[i].ResolvedLink = &resolved
+			return nil
+		}
+	}
+	runParallel(r.Context(), tasks...)
+
+	writeJSON(w, r, http.StatusOK, ResolveBatchResponse{
+		Success: true,
+		Results: results,
+	})
+}
+
+// maxNormalizeIDs caps the inputs of one /spotify/normalize-ids request.
+// Normalizing makes no Spotify calls, so it is well above the batch limits.
+const maxNormalizeIDs = 1000
+
+// normalizeID returns the bare id in raw, which may be an id, a URI or a
+// share link. When kind is set, URIs and links must point to that type.
+// Users pick their own ids, which needn't be base62, so for kind "user" any
+// entry that isn't a URI or link is taken as an id.
+func normalizeID(raw, kind string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("empty entry")
+	}
+	if kind == "user" {
+		if id := strings.TrimPrefix(raw, "spotify:user:"); id != raw && id != "" && !strings.Contains(id, ":") {
+			return id, nil
+		}
+		if linkKind, _, ok := parseShareLink(raw); ok {
+			return "", fmt.Errorf("%s link, not a user", linkKind)
+		}
+		if strings.ContainsAny(raw, ":/?#") {
+			return "", errors.New("not a Spotify user id or URI")
+		}
+		return raw, nil
+	}
+	if spotifyIDPattern.MatchString(raw) {
+		return raw, nil
+	}
+	linkKind, id, ok := parseShareLink(raw)
+	if !ok {
+		return "", errors.New("not a 22-character Spotify id, or a Spotify link or URI for a track, album, artist, playlist, show or episode")
+	}
+	if kind != "" && linkKind != kind {
+		return "", fmt.Errorf("%s link, not a %s", linkKind, kind)
+	}
+	return id, nil
+}
+
+// handleNormalizeIDs cleans up a JSON body of the form {"ids": [...],
+// "type": "..."} before a batch lookup, without calling Spotify. Each entry
+// may be an id, a URI or a share link.
+func handleNormalizeIDs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use POST to normalize ids")
+		return
+	}
+
+	var req struct {
+		IDs  []string `json:"ids"`
+		Type string   `json:"type"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	v := &validator{}
+	if len(req.IDs) == 0 {
+		v.add("ids", "ids must contain at least one entry")
+	}
+	if len(req.IDs) > maxNormalizeIDs {
+		v.add("ids", fmt.Sprintf("at most %d ids are allowed", maxNormalizeIDs))
+	}
+	if req.Type != "" && !shareLinkTypes[req.Type] {
+		v.add("type", "type must be one of: track, album, artist, playlist, show, episode")
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	response := NormalizeIDsResponse{
+		Success:  true,
+		IDs:      []string{},
+		Rejected: []RejectedID{},
+	}
+	for _, raw := range req.IDs {
+		id, err := normalizeID(raw, req.Type)
+		if err != nil {
+			response.Rejected = append(response.Rejected, RejectedID{Input: raw, Reason: err.Error()})
+			continue
+		}
+		response.IDs = append(response.IDs, id)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// resolveLink looks up the item behind a share link.
+func resolveLink(ctx context.Context, client *SpotifyClient, link, market string) (ResolvedLink, error) {
+	kind, id, ok := parseShareLink(link)
+	if !ok {
+		return ResolvedLink{}, errInvalidShareLink
+	}
+	endpoint := "/" + kind + "s/" + id
+
+	var item interface{}
+	var err error
+	switch kind {
+	case "track":
+		var track spotifyTrack
+		if err = getInMarket(ctx, client, endpoint, market, &track); err == nil {
+			item = getTrackInfo(track)
+		}
+	case "album":
+		var album spotifyAlbum
+		if err = getInMarket(ctx, client, endpoint, market, &album); err == nil {
+			item = getAlbumInfo(album)
+		}
+	case "artist":
+		var artist spotifyArtist
+		if err = client.getJSON(ctx, endpoint, &artist); err == nil {
+			item = getSimilarArtist(artist)
+		}
+	case "playlist":
+		var playlist spotifyPlaylist
+		if err = client.getJSON(ctx, withMarket(endpoint+"?fields="+url.QueryEscape(playlistFields), market), &playlist); err == nil {
+			item = getPlaylist(playlist)
+		}
+	case "show":
+		var show spotifyShow
+		if err = getInMarket(ctx, client, endpoint, market, &show); err == nil {
+			item = getShowInfo(show)
+		}
+	case "episode":
+		var episode spotifyEpisode
+		if err = getInMarket(ctx, client, endpoint, market, &episode); err == nil {
+			item = getEpisodeInfo(episode)
+		}
+	}
+	if err != nil {
+		return ResolvedLink{}, err
+	}
+	return ResolvedLink{
+		Type: kind,
+		ID:   id,
+		URL:  "https://open.spotify.com/" + kind + "/" + id,
+		Item: item,
+	}, nil
+}
+
+// handleSearchCount returns how many results a search has for each
+// requested type without returning the results themselves.
+func handleSearchCount(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.searchText(r, "q")
+	types := v.searchTypes(r)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	// Results are keyed by the plural of their type, e.g. "tracks".
+	var searchResult map[string]spotifyPageInfo
+	if err := client.getJSON(r.Context(), withMarket("/search?q="+url.QueryEscape(query)+"&type="+strings.Join(types, ",")+"&limit=1", market), &searchResult); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	counts := make(map[string]int, len(types))
+	for _, t := range types {
+		counts[t] = searchResult[t+"s"].Total
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"query":   query,
+		"counts":  counts,
+	})
+}
+
+// rankedSearchTypes are the search types that carry a popularity score.
+var rankedSearchTypes = []string{"album", "artist", "track"}
+
+// handleSearchRanked searches several types at once and returns the results
+// as a single list ranked by popularity.
+func handleSearchRanked(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	query := v.searchText(r, "q")
+	types := rankedSearchTypes
+	if raw := r.URL.Query().Get("type"); raw != "" {
+		types = strings.Split(raw, ",")
+		for _, t := range types {
+			if !containsString(rankedSearchTypes, t) {
+				v.add("type", fmt.Sprintf("type must be a comma-separated list of: %s", strings.Join(rankedSearchTypes, ", ")))
+				break
+			}
+		}
+	}
+	limit := v.intRange(r, "limit", 10, 1, maxAlbumsPerRequest)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var searchResult struct {
+		Albums  spotifyAlbumPage `json:"albums"`
+		Artists struct {
+			Items []spotifyArtist `json:"items"`
+		} `json:"artists"`
+		Tracks spotifyTrackPage `json:"tracks"`
+	}
+	if err := client.getJSON(r.Context(), withMarket(fmt.Sprintf("/search?q=%s&type=%s&limit=%d", url.QueryEscape(query), strings.Join(types, ","), limit), market), &searchResult); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	// Albums in search results have no popularity, so look them up in one
+	// batch before ranking.
+	albums, err := withPopularity(r.Context(), client, searchResult.Albums.Items, market)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	results := searchResults(searchResult.Artists.Items, albums, searchResult.Tracks.Items)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Popularity > results[j].Popularity })
+
+	writeJSON(w, r, http.StatusOK, RankedSearchResponse{
+		Success: true,
+		Query:   query,
+		Results: results,
+	})
+}
+
+// withPopularity looks up albums from search results, which lack a
+// popularity, in one batch.
+func withPopularity(ctx context.Context, client *SpotifyClient, albums []spotifyAlbum, market string) ([]spotifyAlbum, error) {
+	if len(albums) == 0 {
+		return albums, nil
+	}
+	ids := make([]string, len(albums))
+	for i, album := range albums {
+		ids[i] = album.ID
+	}
+	var albumsResult struct {
+		Albums []spotifyAlbum `json:"albums"`
+	}
+	if err := client.getJSON(ctx, withMarket("/albums?ids="+strings.Join(ids, ","), market), &albumsResult); err != nil {
+		return nil, err
+	}
+	return albumsResult.Albums, nil
+}
+
+// searchResults converts search results to SearchResults, artists first,
+// then albums, then tracks.
+func searchResults(artists []spotifyArtist, albums []spotifyAlbum, tracks []spotifyTrack) []SearchResult {
+	results := []SearchResult{}
+	for _, artist := range artists {
+		results = append(results, SearchResult{
+			Type:       "artist",
+			ID:         artist.ID,
+			Name:       artist.Name,
+			Subtitle:   strings.Join(artist.Genres, ", "),
+			Image:      getArtistImage(artist),
+			Popularity: artist.Popularity,
+		})
+	}
+	for _, album := range albums {
+		if album.ID == "" {
+			continue
+		}
+		results = append(results, SearchResult{
+			Type:       "album",
+			ID:         album.ID,
+			Name:       album.Name,
+			Subtitle:   artistNames(album.Artists),
+			Image:      firstImage(album.Images),
+			Popularity: album.Popularity,
+		})
+	}
+	for _, track := range tracks {
+		var image string
+		if track.Album != nil {
+			image = firstImage(track.Album.Images)
+		}
+		results = append(results, SearchResult{
+			Type:       "track",
+			ID:         track.ID,
+			Name:       track.Name,
+			Subtitle:   artistNames(track.Artists),
+			Image:      image,
+			Popularity: track.Popularity,
+		})
+	}
+	return results
+}
+
+// searchFilters are the parameters of /spotify/search/fields, in the order
+// they are added to the query, with the search types Spotify applies each
+// filter to.
+var searchFilters = []struct {
+	field string
+	types []string
+}{
+	{"track", []string{"track"}},
+	{"artist", []string{"album", "artist", "track"}},
+	{"album", []string{"album", "track"}},
+	{"year", []string{"album", "artist", "track"}},
+	{"genre", []string{"artist", "track"}},
+	{"label", []string{"album", "track"}},
+}
+
+var yearPattern = regexp.MustCompile(`^\d{4}(-\d{4})?$`)
+
+// handleSearchFields searches one type with a query built from separate
+// filter parameters, so clients don't need to know Spotify's filter syntax.
+func handleSearchFields(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	params := r.URL.Query()
+	searchType := params.Get("type")
+	if searchType == "" {
+		searchType = "track"
+	}
+	if !containsString(rankedSearchTypes, searchType) {
+		v.add("type", fmt.Sprintf("type must be one of: %s", strings.Join(rankedSearchTypes, ", ")))
+	}
+
+	var terms []string
+	if q := params.Get("q"); q != "" {
+		terms = append(terms, q)
+	}
+	for _, filter := range searchFilters {
+		value := strings.TrimSpace(params.Get(filter.field))
+		if value == "" {
+			continue
+		}
+		switch {
+		case len(value) > maxSearchLength:
+			v.add(filter.field, fmt.Sprintf("%s must be at most %d characters", filter.field, maxSearchLength))
+		case filter.field == "year" && !yearPattern.MatchString(value):
+			v.add("year", "year must be a year such as 1999 or a range such as 1990-1999")
+		case !containsString(filter.types, searchType):
+			v.add(filter.field, fmt.Sprintf("%s can only be used when searching for types: %s", filter.field, strings.Join(filter.types, ", ")))
+		}
+		// Quotes can't be escaped inside a filter value, so drop them.
+		value = strings.Replace(value, `"`, "", -1)
+		if strings.ContainsAny(value, " \t") {
+			value = `"` + value + `"`
+		}
+		terms = append(terms, filter.field+":"+value)
+	}
+	if len(terms) == 0 {
+		v.add("q", "at least one of q, track, artist, album, year, genre or label is required")
+	}
+	query := strings.Join(terms, " ")
+	if len(query) > maxSearchLength {
+		v.add("q", fmt.Sprintf("the combined query must be at most %d characters", maxSearchLength))
+	}
+	limit := v.intRange(r, "limit", 10, 1, maxAlbumsPerRequest)
+	market := v.market(r)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	var searchResult struct {
+		Albums  spotifyAlbumPage `json:"albums"`
+		Artists struct {
+			spotifyPageInfo
+			Items []spotifyArtist `json:"items"`
+		} `json:"artists"`
+		Tracks spotifyTrackPage `json:"tracks"`
+	}
+	if err := client.getJSON(r.Context(), withMarket(fmt.Sprintf("/search?q=%s&type=%s&limit=%d", url.QueryEscape(query), searchType, limit), market), &searchResult); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	albums, err := withPopularity(r.Context(), client, searchResult.Albums.Items, market)
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	response := FieldSearchResponse{
+		Success: true,
+		Query:   query,
+		Type:    searchType,
+		Results: searchResults(searchResult.Artists.Items, albums, searchResult.Tracks.Items),
+	}
+	switch searchType {
+	case "album":
+		response.Total = searchResult.Albums.Total
+	case "artist":
+		response.Total = searchResult.Artists.Total
+	case "track":
+		response.Total = searchResult.Tracks.Total
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// handlePage follows a Spotify paging URL (the albumsNext, tracksNext or
+// next value of a previous response) and returns the page in the same shape as the
+// endpoint it came from.
+func handlePage(w http.ResponseWriter, r *http.Request) {
+	v := &validator{}
+	rawURL := v.require(r, "url")
+	prefetch := v.boolean(r, "prefetch", false)
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	endpoint, err := pagingEndpoint(rawURL)
+	if err != nil {
+		v.add("url", err.Error())
+		v.writeError(w, r)
+		return
+	}
+
+	var pageType string
+	switch {
+	case artistAlbumsPath.MatchString(endpoint):
+		pageType = "albums"
+	case albumTracksPath.MatchString(endpoint):
+		pageType = "tracks"
+	case audiobookChaptersPath.MatchString(endpoint):
+		pageType = "chapters"
+	default:
+		v.add("url", "url is not a supported paging URL")
+		v.writeError(w, r)
+		return
+	}
+
+	client := spotifyClient
+
+	response := PageResponse{
+		Success: true,
+		Type:    pageType,
+	}
+	var info spotifyPageInfo
+	switch pageType {
+	case "albums":
+		var page spotifyAlbumPage
+		err = client.getJSON(r.Context(), endpoint, &page)
+		info, response.Items = page.spotifyPageInfo, getAlbums(page.Items)
+	case "tracks":
+		var page spotifyTrackPage
+		err = client.getJSON(r.Context(), endpoint, &page)
+		info, response.Items = page.spotifyPageInfo, getTracks(page.Items)
+	case "chapters":
+		var page spotifyChapterPage
+		err = client.getJSON(r.Context(), endpoint, &page)
+		info, response.Items = page.spotifyPageInfo, getChapters(page.Items)
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	response.Total = info.Total
+	response.Next = info.Next
+	response.Previous = info.Previous
+	if prefetch {
+		prefetchPage(client, info.Next)
+	}
+
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+var (
+	artistAlbumsPath      = regexp.MustCompile(`^/artists/[A-Za-z0-9]+/albums\?`)
+	albumTracksPath       = regexp.MustCompile(`^/albums/[A-Za-z0-9]+/tracks\?`)
+	audiobookChaptersPath = regexp.MustCompile(`^/audiobooks/[A-Za-z0-9]+/chapters\?`)
+)
+
+// pagingEndpoint checks that rawURL is a Spotify Web API URL and returns it
+// relative to the API base, ready to be passed to makeRequest.
+func pagingEndpoint(rawURL string) (string, error) {
+	u, err := validateSpotifyURL(rawURL, "api.spotify.com")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(u.EscapedPath(), "/v1/") {
+		return "", fmt.Errorf("url must be a Spotify Web API v1 URL")
+	}
+	endpoint := strings.TrimPrefix(u.EscapedPath(), "/v1")
+	if u.RawQuery != "" {
+		endpoint += "?" + u.RawQuery
+	}
+	return endpoint, nil
+}
+
+func formatDuration(ms int) string {
+	seconds := ms / 1000
+	minutes := seconds / 60
+	seconds = seconds % 60
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
+
+// formatClockDuration is formatDuration with hours for durations of an
+// hour or more, such as 1:02:05, as long podcast episodes have.
+func formatClockDuration(ms int) string {
+	seconds := ms / 1000
+	if seconds < 3600 {
+		return formatDuration(ms)
+	}
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// formatISODuration formats milliseconds as an ISO 8601 duration such as
+// PT3M21S or PT1H2M5S, dropping zero parts and the milliseconds.
+func formatISODuration(ms int) string {
+	seconds := ms / 1000
+	hours, minutes := seconds/3600, seconds/60%60
+	seconds %= 60
+
+	result := "PT"
+	if hours > 0 {
+		result += fmt.Sprintf("%dH", hours)
+	}
+	if minutes > 0 {
+		result += fmt.Sprintf("%dM", minutes)
+	}
+	if seconds > 0 || result == "PT" {
+		result += fmt.Sprintf("%dS", seconds)
+	}
+	return result
+}
+
+func getTrackInfo(track spotifyTrack) TrackInfo {
+	fullTitle := track.Name
+	if len(track.Artists) > 0 {
+		fullTitle += " - " + artistNames(track.Artists)
+	}
+	return TrackInfo{
+		Name:       track.Name,
+		FullTitle:  fullTitle,
+		ID:         track.ID,
+		URL:        track.ExternalURLs.Spotify,
+		PreviewURL: track.PreviewURL,
+		Duration:   formatDuration(track.DurationMs),
+		DurationMs: track.DurationMs,
+		Explicit:   track.Explicit,
+		Popularity: track.Popularity,
+		ISRC:       track.ExternalIDs["isrc"],
+
+		Restrictions: getRestrictions(track.Restrictions),
+	}
+}
+
+// getRestrictions converts a track's or album's restrictions, returning nil
+// when there are none, as for most of them.
+func getRestrictions(restrictions *spotifyRestrictions) *Restrictions {
+	if restrictions == nil || restrictions.Reason == "" {
+		return nil
+	}
+	return &Restrictions{Reason: restrictions.Reason}
+}
+
+// trackAlbums is the default for the album parameter of the track endpoints.
+var trackAlbums = false
+
+// getTrackAlbum converts the album embedded in a track, or returns nil when
+// the track has none.
+func getTrackAlbum(album *spotifyAlbum) *TrackAlbum {
+	if album == nil {
+		return nil
+	}
+	return &TrackAlbum{
+		Name:        album.Name,
+		ID:          album.ID,
+		URL:         album.ExternalURLs.Spotify,
+		ReleaseDate: album.ReleaseDate,
+		Artists:     getArtists(album.Artists),
+		Images:      getImages(album.Images),
+	}
+}
+
+func getEpisodeInfo(episode spotifyEpisode) EpisodeInfo {
+	return EpisodeInfo{
+		Name:        episode.Name,
+		ID:          episode.ID,
+		URL:         episode.ExternalURLs.Spotify,
+		Show:        episode.Show.Name,
+		Description: html.UnescapeString(episode.Description),
+		ReleaseDate: episode.ReleaseDate,
+		Duration:    formatDuration(episode.DurationMs),
+		DurationMs:  episode.DurationMs,
+		Explicit:    episode.Explicit,
+		Images:      getImages(episode.Images),
+	}
+}
+
+func getChapters(chapters []spotifyChapter) []ChapterInfo {
+	result := make([]ChapterInfo, len(chapters))
+	for i, chapter := range chapters {
+		result[i] = ChapterInfo{
+			Name:          chapter.Name,
+			ID:            chapter.ID,
+			URL:           chapter.ExternalURLs.Spotify,
+			ChapterNumber: chapter.ChapterNumber,
+			PreviewURL:    chapter.AudioPreviewURL,
+			Duration:      formatDuration(chapter.DurationMs),
+			DurationMs:    chapter.DurationMs,
+			Explicit:      chapter.Explicit,
+			ReleaseDate:   chapter.ReleaseDate,
+			Images:        getImages(chapter.Images),
+		}
+	}
+	return result
+}
+
+// getShowInfo converts a show. Spotify's plain-text descriptions still
+// contain HTML entities such as &amp;, so they are decoded.
+func getShowInfo(show spotifyShow) ShowInfo {
+	languages := show.Languages
+	if languages == nil {
+		languages = []string{}
+	}
+	return ShowInfo{
+		Name:          show.Name,
+		ID:            show.ID,
+		URL:           show.ExternalURLs.Spotify,
+		Publisher:     show.Publisher,
+		Description:   html.UnescapeString(show.Description),
+		TotalEpisodes: show.TotalEpisodes,
+		Explicit:      show.Explicit,
+		Languages:     languages,
+		Images:        getImages(show.Images),
+	}
+}
+
+func getArtistInfo(artist spotifyArtist, stats AlbumStats) ArtistInfo {
+	return ArtistInfo{
+		Name:         artist.Name,
+		ID:           artist.ID,
+		URL:          artist.ExternalURLs.Spotify,
+		Image:        getArtistImage(artist),
+		Genres:       artist.Genres,
+		Followers:    artist.Followers.Total,
+		Popularity:   artist.Popularity,
+		Albums:       stats.Album,
+		Singles:      stats.Single,
+		Compilations: stats.Compilation,
+	}
+}
+
+func getSimilarArtist(artist spotifyArtist) SimilarArtist {
+	return SimilarArtist{
+		Name:       artist.Name,
+		ID:         artist.ID,
+		URL:        artist.ExternalURLs.Spotify,
+		Image:      getArtistImage(artist),
+		Genres:     artist.Genres,
+		Popularity: artist.Popularity,
+	}
+}
+
+func getAlbumInfo(album spotifyAlbum) AlbumInfo {
+	thumbnail, cover := getImageSizes(album.Images)
+	return AlbumInfo{
+		Name:        album.Name,
+		Artists:     getArtists(album.Artists),
+		ReleaseDate: album.ReleaseDate,
+		Genres:      album.Genres,
+		TotalTracks: album.TotalTracks,
+		Popularity:  album.Popularity,
+		Type:        album.AlbumType,
+		URL:         album.ExternalURLs.Spotify,
+		Images:      getImages(album.Images),
+		Thumbnail:   thumbnail,
+		Cover:       cover,
+		Tracks:      getTracks(album.Tracks.Items),
+		TracksNext:  album.Tracks.Next,
+		UPC:         album.ExternalIDs["upc"],
+
+		Restrictions: getRestrictions(album.Restrictions),
+	}
+}
+
+func getArtistImage(artist spotifyArtist) string {
+	return firstImage(artist.Images)
+}
+
+// maxImageBytes caps the size of an image downloaded to compute its color.
+const maxImageBytes = 4 << 20
+
+// imageColors caches dominant colors by image URL. Spotify never changes
+// the image behind a URL, so entries don't expire; once the cache is full an
+// arbitrary entry makes room for each new one.
+var imageColors = struct {
+	sync.Mutex
+	colors map[string]string
+}{colors: make(map[string]string)}
+
+const maxImageColors = 10000
+
+// artistColor returns the dominant color of the artist's image as a hex
+// string, or "" when the artist has no image. Failures are logged rather
+// than failing the request, as the color is only cosmetic.
+func artistColor(ctx context.Context, client *SpotifyClient, artist spotifyArtist) string {
+	imageURL := getArtistImage(artist)
+	if imageURL == "" {
+		return ""
+	}
+	color, err := imageColor(ctx, client, imageURL)
+	if err != nil {
+		fmt.Printf("Color of %s: %v\n", imageURL, err)
+		return ""
+	}
+	return color
+}
+
+// imageColor downloads the image at imageURL and returns its dominant color.
+func imageColor(ctx context.Context, client *SpotifyClient, imageURL string) (string, error) {
+	imageColors.Lock()
+	color, ok := imageColors.colors[imageURL]
+	imageColors.Unlock()
+	if ok {
+		return color, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("image download failed with status %d", resp.StatusCode)
+	}
+	img, _, err := image.Decode(io.LimitReader(resp.Body, maxImageBytes))
+	if err != nil {
+		return "", err
+	}
+	color = dominantColor(img)
+
+	imageColors.Lock()
+	if len(imageColors.colors) >= maxImageColors {
+		for key := range imageColors.colors {
+			delete(imageColors.colors, key)
+			break
+		}
+	}
+	imageColors.colors[imageURL] = color
+	imageColors.Unlock()
+	return color, nil
+}
+
+// dominantColor quantizes img to 4 bits per channel and returns the average
+// of the pixels in the most common bucket, as "#rrggbb". Averaging within
+// the bucket keeps the color true to the image while the bucketing stops a
+// blend of unrelated colors from winning, as a plain average would. Large
+// images are sampled on a grid of about 100x100 pixels.
+func dominantColor(img image.Image) string {
+	bounds := img.Bounds()
+	step := bounds.Dx() / 100
+	if h := bounds.Dy() / 100; h > step {
+		step = h
+	}
+	if step < 1 {
+		step = 1
+	}
+
+	var counts [4096]int
+	var sums [4096][3]int
+	best := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			r, g, b = r>>8, g>>8, b>>8
+			bucket := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			counts[bucket]++
+			sums[bucket][0] += int(r)
+			sums[bucket][1] += int(g)
+			sums[bucket][2] += int(b)
+			if counts[bucket] > counts[best] {
+				best = bucket
+			}
+		}
+	}
+	n := counts[best]
+	if n == 0 {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
+
+// firstImage returns the URL of the first, and largest, image.
+func firstImage(images []spotifyImage) string {
+	if len(images) > 0 {
+		return images[0].URL
+	}
+	return ""
+}
+
+func artistNames(artists []spotifySimpleArtist) string {
+	names := make([]string, len(artists))
+	for i, artist := range artists {
+		names[i] = artist.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func getTopTracks(tracks []spotifyTrack) []TopTrackInfo {
+	result := make([]TopTrackInfo, len(tracks))
+	for i, t := range tracks {
+		result[i] = TopTrackInfo{
+			Name:       t.Name,
+			Popularity: t.Popularity,
+		}
+	}
+	return result
+}
+
+func getAlbums(albums []spotifyAlbum) []AlbumBasicInfo {
+	result := make([]AlbumBasicInfo, len(albums))
+	for i, a := range albums {
+		result[i] = AlbumBasicInfo{
+			Name: a.Name,
+			Type: a.AlbumType,
+		}
+	}
+	return result
+}
+
+func getAlbumStats(albums []spotifyAlbum) AlbumStats {
+	var stats AlbumStats
+	for _, a := range albums {
+		switch a.AlbumType {
+		case "album":
+			stats.Album++
+		case "single":
+			stats.Single++
+		case "compilation":
+			stats.Compilation++
+		}
+	}
+	return stats
+}
+
+// nonCompilationGroups are the album groups requested when compilations are
+// excluded. Spotify filters by group before paging, so limit, next and total
+// still describe the albums returned.
+const nonCompilationGroups = "album,single"
+
+func getArtists(artists []spotifySimpleArtist) []ArtistBasic {
+	result := make([]ArtistBasic, len(artists))
+	for i, a := range artists {
+		result[i] = ArtistBasic{
+			Name: a.Name,
+			ID:   a.ID,
+			URL:  a.ExternalURLs.Spotify,
+		}
+	}
+	return result
+}
+
+func getImages(images []spotifyImage) []ImageInfo {
+	result := make([]ImageInfo, len(images))
+	for i, img := range images {
+		// Uploaded playlist covers have no dimensions and decode as 0.
+		result[i] = ImageInfo{
+			URL:    img.URL,
+			Height: img.Height,
+			Width:  img.Width,
+		}
+	}
+	return result
+}
+
+// getImageSizes returns the smallest and largest of images, or nils when
+// there are none. Images without dimensions keep Spotify's largest-first
+// order.
+func getImageSizes(images []spotifyImage) (thumbnail, cover *ImageInfo) {
+	if len(images) == 0 {
+		return nil, nil
+	}
+	smallest, largest := 0, 0
+	for i, img := range images {
+		area := img.Height * img.Width
+		if area <= images[smallest].Height*images[smallest].Width {
+			smallest = i
+		}
+		if area > images[largest].Height*images[largest].Width {
+			largest = i
+		}
+	}
+	sizes := getImages([]spotifyImage{images[smallest], images[largest]})
+	return &sizes[0], &sizes[1]
+}
+
+func getPlaylist(p spotifyPlaylist) PlaylistInfo {
+	thumbnail, cover := getImageSizes(p.Images)
+	info := PlaylistInfo{
+		Name:        p.Name,
+		ID:          p.ID,
+		Description: p.Description,
+		Public:      p.Public,
+		Owner:       p.Owner.DisplayName,
+		URL:         p.ExternalURLs.Spotify,
+		Images:      getImages(p.Images),
+		Thumbnail:   thumbnail,
+		Cover:       cover,
+		TotalTracks: p.Tracks.Total,
+	}
+	if p.Followers != nil {
+		info.Followers = &p.Followers.Total
+	}
+	return info
+}
+
+func getAudioFeatures(f spotifyAudioFeatures) *AudioFeatures {
+	return &AudioFeatures{
+		Acousticness:     f.Acousticness,
+		Danceability:     f.Danceability,
+		Energy:           f.Energy,
+		Instrumentalness: f.Instrumentalness,
+		Liveness:         f.Liveness,
+		Speechiness:      f.Speechiness,
+		Valence:          f.Valence,
+		Loudness:         f.Loudness,
+		Tempo:            f.Tempo,
+		Key:              f.Key,
+		Mode:             f.Mode,
+		TimeSignature:    f.TimeSignature,
+	}
+}
+
+func getTracks(tracks []spotifyTrack) []TrackBasic {
+	result := make([]TrackBasic, len(tracks))
+	for i, t := range tracks {
+		result[i] = TrackBasic{
+			Name:        t.Name,
+			Duration:    t.DurationMs,
+			TrackNumber: t.TrackNumber,
+			URL:         t.ExternalURLs.Spotify,
+		}
+	}
+	return result
+}
+
+// ArtistWatch asks for a webhook to CallbackURL whenever the artist releases
+// something newer than LatestRelease.
+type ArtistWatch struct {
+	ID            string    `json:"id"`
+	ArtistID      string    `json:"artistId"`
+	ArtistName    string    `json:"artistName"`
+	CallbackURL   string    `json:"callbackUrl"`
+	LatestRelease string    `json:"latestRelease"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// WatchStore persists artist watches. Implementations must be safe for
+// concurrent use.
+type WatchStore interface {
+	List() ([]ArtistWatch, error)
+	Put(watch ArtistWatch) error
+	Delete(id string) (bool, error)
+	// Advance sets the latest release of watch id to to, but only if the
+	// watch still exists and its latest release is still from, so that a
+	// poll can't bring back a watch deleted while it ran.
+	Advance(id, from, to string) (bool, error)
+}
+
+// memoryWatchStore keeps watches for the life of the process.
+type memoryWatchStore struct {
+	mu      sync.Mutex
+	watches map[string]ArtistWatch
+}
+
+func newMemoryWatchStore() *memoryWatchStore {
+	return &memoryWatchStore{watches: make(map[string]ArtistWatch)}
+}
+
+func (s *memoryWatchStore) List() ([]ArtistWatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watches := make([]ArtistWatch, 0, len(s.watches))
+	for _, watch := range s.watches {
+		watches = append(watches, watch)
+	}
+	sort.Slice(watches, func(i, j int) bool { return watches[i].CreatedAt.Before(watches[j].CreatedAt) })
+	return watches, nil
+}
+
+func (s *memoryWatchStore) Put(watch ArtistWatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watches[watch.ID] = watch
+	return nil
+}
+
+func (s *memoryWatchStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.watches[id]
+	delete(s.watches, id)
+	return ok, nil
+}
+
+func (s *memoryWatchStore) Advance(id, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watch, ok := s.watches[id]
+	if !ok || watch.LatestRelease != from {
+		return false, nil
+	}
+	watch.LatestRelease = to
+	s.watches[id] = watch
+	return true, nil
+}
+
+// fileWatchStore is memoryWatchStore saved to a JSON file after every
+// change, so watches survive restarts of a single instance.
+type fileWatchStore struct {
+	path string
+
+	mu     sync.Mutex
+	memory *memoryWatchStore
+}
+
+// newFileWatchStore loads the watches saved at path, which need not exist
+// yet.
+func newFileWatchStore(path string) (*fileWatchStore, error) {
+	s := &fileWatchStore{path: path, memory: newMemoryWatchStore()}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []ArtistWatch
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, watch := range saved {
+		s.memory.watches[watch.ID] = watch
+	}
+	return s, nil
+}
+
+// save writes every watch to a temporary file and renames it over s.path,
+// so a crash never leaves a half-written file. s.mu must be held.
+func (s *fileWatchStore) save() error {
+	list, _ := s.memory.List()
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *fileWatchStore) List() ([]ArtistWatch, error) {
+	return s.memory.List()
+}
+
+func (s *fileWatchStore) Put(watch ArtistWatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory.Put(watch)
+	return s.save()
+}
+
+func (s *fileWatchStore) Delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, _ := s.memory.Delete(id)
+	if !ok {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+func (s *fileWatchStore) Advance(id, from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, _ := s.memory.Advance(id, from, to)
+	if !ok {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// redisWatchStore keeps watches in a Redis hash of id to JSON, shared by
+// every instance using the same Redis server.
+type redisWatchStore struct {
+	client *redisClient
+}
+
+const redisWatchesKey = "spotify:watches"
+
+// redisAdvanceScript is Advance run atomically inside Redis.
+const redisAdvanceScript = `local current = redis.call('HGET', KEYS[1], ARGV[1])
+if not current then return 0 end
+local watch = cjson.decode(current)
+if watch.latestRelease ~= ARGV[2] then return 0 end
+watch.latestRelease = ARGV[3]
+redis.call('HSET', KEYS[1], ARGV[1], cjson.encode(watch))
+return 1`
+
+func (s *redisWatchStore) List() ([]ArtistWatch, error) {
+	reply, err := s.client.do("HGETALL", redisWatchesKey)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]interface{})
+	watches := make([]ArtistWatch, 0, len(fields)/2)
+	for i := 1; i < len(fields); i += 2 {
+		data, _ := fields[i].([]byte)
+		var watch ArtistWatch
+		if err := json.Unmarshal(data, &watch); err != nil {
+			return nil, err
+		}
+		watches = append(watches, watch)
+	}
+	sort.Slice(watches, func(i, j int) bool { return watches[i].CreatedAt.Before(watches[j].CreatedAt) })
+	return watches, nil
+}
+
+func (s *redisWatchStore) Put(watch ArtistWatch) error {
+	data, err := json.Marshal(watch)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.do("HSET", redisWatchesKey, watch.ID, string(data))
+	return err
+}
+
+func (s *redisWatchStore) Delete(id string) (bool, error) {
+	reply, err := s.client.do("HDEL", redisWatchesKey, id)
+	if err != nil {
+		return false, err
+	}
+	removed, _ := reply.(int64)
+	return removed > 0, nil
+}
+
+func (s *redisWatchStore) Advance(id, from, to string) (bool, error) {
+	reply, err := s.client.do("EVAL", redisAdvanceScript, "1", redisWatchesKey, id, from, to)
+	if err != nil {
+		return false, err
+	}
+	advanced, _ := reply.(int64)
+	return advanced == 1, nil
+}
+
+var (
+	// watches holds registered artist watches.
+	watches WatchStore = newMemoryWatchStore()
+
+	// webhookSecret signs webhook payloads. /watch/artist is only served
+	// when it is set.
+	webhookSecret string
+)
+
+// maxWatches bounds how many watches can be registered.
+const maxWatches = 1000
+
+// handleWatchArtist lists (GET), registers (POST) or removes (DELETE) artist
+// release watches.
+func handleWatchArtist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := watches.List()
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"watches": list,
+		})
+	case http.MethodPost:
+		createWatch(w, r)
+	case http.MethodDelete:
+		v := &validator{}
+		id := v.require(r, "id")
+		if !v.valid() {
+			v.writeError(w, r)
+			return
+		}
+		ok, err := watches.Delete(id)
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "No watch with that id")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"success": true})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, "Use GET to list, POST to add or DELETE to remove watches")
+	}
+}
+
+// createWatch registers a watch from a JSON body of the form
+// {"artistId": ..., "callbackUrl": ...}. The artist's current latest release
+// is recorded so only later releases trigger the webhook.
+func createWatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ArtistID    string `json:"artistId"`
+		CallbackURL string `json:"callbackUrl"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	v := &validator{}
+	if req.ArtistID == "" {
+		v.add("artistId", "artistId is required")
+	}
+	if err := validateCallbackURL(r.Context(), req.CallbackURL); err != nil {
+		v.add("callbackUrl", err.Error())
+	}
+	if !v.valid() {
+		v.writeError(w, r)
+		return
+	}
+
+	existing, err := watches.List()
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	if len(existing) >= maxWatches {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("At most %d watches can be registered", maxWatches))
+		return
+	}
+
+	var artist spotifyArtist
+	if err := spotifyClient.getJSON(r.Context(), "/artists/"+url.PathEscape(req.ArtistID), &artist); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	albums, err := fetchAllAlbums(r.Context(), spotifyClient, artist.ID, "", strings.Join(latestReleaseTypes, ","))
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	latest := latestReleases(albums, "")
+
+	watch := ArtistWatch{
+		ID:          randomID(),
+		ArtistID:    artist.ID,
+		ArtistName:  artist.Name,
+		CallbackURL: req.CallbackURL,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if len(latest) > 0 {
+		watch.LatestRelease = latest[0].ReleaseDate
+	}
+	if err := watches.Put(watch); err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"success": true,
+		"watch":   watch,
+	})
+}
+
+// pollWatches checks every watch for new releases each interval until ctx
+// is done.
+func pollWatches(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		list, err := watches.List()
+		if err != nil {
+			fmt.Printf("Listing watches failed: %v\n", err)
+			continue
+		}
+		for _, watch := range list {
+			if err := checkWatch(ctx, watch); err != nil {
+				fmt.Printf("Checking watch %s for artist %s failed: %v\n", watch.ID, watch.ArtistID, err)
+			}
+		}
+	}
+}
+
+// checkWatch sends a webhook for each release newer than the watch's latest
+// and records the newest one. The watch is only advanced once every webhook
+// has been delivered, so failed deliveries are retried on the next poll.
+func checkWatch(ctx context.Context, watch ArtistWatch) error {
+	albums, err := fetchAllAlbums(ctx, spotifyClient, watch.ArtistID, "", strings.Join(latestReleaseTypes, ","))
+	if err != nil {
+		return err
+	}
+	releases := latestReleases(albums, watch.LatestRelease)
+	if len(releases) == 0 {
+		return nil
+	}
+
+	for _, album := range releases {
+		if err := sendReleaseWebhook(ctx, watch, album); err != nil {
+			return err
+		}
+	}
+	// A watch deleted or advanced by another instance meanwhile is left
+	// as it is.
+	_, err = watches.Advance(watch.ID, watch.LatestRelease, releases[0].ReleaseDate)
+	return err
+}
+
+// webhookClient delivers webhooks. Its dialer refuses non-public addresses,
+// which also covers callback hosts that resolve differently after they were
+// validated.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// releaseWebhook is the body of a release webhook.
+type releaseWebhook struct {
+	Event      string `json:"event"`
+	WatchID    string `json:"watchId"`
+	ArtistID   string `json:"artistId"`
+	ArtistName string `json:"artistName"`
+	Album      struct {
+		Name        string `json:"name"`
+		ID          string `json:"id"`
+		ReleaseDate string `json:"releaseDate"`
+		TotalTracks int    `json:"totalTracks"`
+		Type        string `json:"type"`
+		URL         string `json:"url"`
+	} `json:"album"`
+}
+
+// sendReleaseWebhook POSTs a release event to the watch's callback URL. The
+// body is signed with HMAC-SHA256 using webhookSecret; the hex signature is
+// sent as "X-Webhook-Signature: sha256=<signature>".
+func sendReleaseWebhook(ctx context.Context, watch ArtistWatch, album spotifyAlbum) error {
+	event := releaseWebhook{
+		Event:      "artist.release",
+		WatchID:    watch.ID,
+		ArtistID:   watch.ArtistID,
+		ArtistName: watch.ArtistName,
+	}
+	event.Album.Name = album.Name
+	event.Album.ID = album.ID
+	event.Album.ReleaseDate = album.ReleaseDate
+	event.Album.TotalTracks = album.TotalTracks
+	event.Album.Type = album.AlbumType
+	event.Album.URL = album.ExternalURLs.Spotify
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write(payload)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", watch.CallbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// validateCallbackURL checks that a webhook callback is an https URL whose
+// host resolves only to public addresses.
+func validateCallbackURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return errors.New("callbackUrl must be a valid URL")
+	}
+	if u.Scheme != "https" || u.User != nil {
+		return errors.New("callbackUrl must be an https URL without credentials")
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("callbackUrl host could not be resolved")
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errors.New("callbackUrl must not point to a private, loopback or link-local address")
+		}
+	}
+	return nil
+}
+
+// nonPublicNetworks are address ranges webhooks must never be sent to.
+var nonPublicNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPublicIP(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsPolicy decides which browser origins may call the API: those in
+// origins exactly, or matching pattern in full.
+type corsPolicy struct {
+	origins map[string]bool
+	pattern *regexp.Regexp
+}
+
+// newCORSPolicy builds a policy from a comma-separated list of origins and
+// an optional regular expression, which must match the whole origin.
+func newCORSPolicy(origins, pattern string) (*corsPolicy, error) {
+	policy := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			policy.origins[origin] = true
+		}
+	}
+	if pattern != "" {
+		var err error
+		if policy.pattern, err = regexp.Compile(`^(?:` + pattern + `)$`); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func (p *corsPolicy) allowed(origin string) bool {
+	return p.origins[origin] || (p.pattern != nil && p.pattern.MatchString(origin))
+}
+
+// corsHandler adds CORS headers for allowed origins, echoing the origin back
+// so cookies for the user endpoints work, and answers their preflight
+// requests. Requests from other origins get no CORS headers.
+func corsHandler(policy *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !policy.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Admin-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipHandler compresses responses for clients that accept gzip, at the
+// given compression level (gzip.BestSpeed to gzip.BestCompression).
+func gzipHandler(next http.Handler, level int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, level: level}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter starts compressing on the first Write, so bodiless
+// responses such as redirects are sent untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level int
+	gz    *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		w.start()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	w.start()
+	return w.gz.Write(b)
+}
+
+func (w *gzipResponseWriter) start() {
+	if w.gz != nil {
 		return
 	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, w.level)
+}
+
+func (w *gzipResponseWriter) Close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
 
-	client := NewSpotifyClient(clientID, clientSecret)
-	
-	data, err := client.makeRequest("GET", "/search?q="+url.QueryEscape(query)+"&type=album&limit=1")
+// redisClient is a minimal client for the Redis commands this service uses.
+// It keeps one connection, reconnecting after errors, and serialises
+// commands over it. Connections are dialled without holding the lock, and
+// after a failed dial commands fail fast for redisReconnectCooldown, so a
+// dead Redis doesn't hold up every caller for a dial timeout.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu        sync.Mutex
+	conn      *redisConn
+	dialing   bool
+	downUntil time.Time
+	dialErr   error
+}
+
+// redisReconnectCooldown is how long commands fail without dialling after a
+// failed dial.
+const redisReconnectCooldown = 5 * time.Second
+
+// redisConn is one connection to Redis.
+type redisConn struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	timeout time.Duration
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisClient parses a redis://[:password@]host[:port][/db] URL.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("redis URL must use the redis scheme, got %q", u.Scheme)
+	}
+	c := &redisClient{addr: u.Host, timeout: 2 * time.Second}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
 	}
+	return c, nil
+}
 
-	var searchResult map[string]interface{}
-	if err := json.Unmarshal(data, &searchResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// do sends a command and returns its reply: a string, int64, []byte, nil or
+// []interface{}.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
 	}
+	reply, err := c.conn.roundTrip(args)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection is in an unknown state; start afresh next time.
+		c.conn.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
 
-	albums := searchResult["albums"].(map[string]interface{})
-	items := albums["items"].([]interface{})
-	if len(items) == 0 {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"message": "No album found",
-		})
-		return
+// reconnect dials a new connection with c.mu released, unless another
+// caller is dialling already or a dial failed within the cooldown, in which
+// case it fails at once. c.mu must be held, and is held again on return.
+func (c *redisClient) reconnect() error {
+	if c.dialing {
+		return errors.New("redis: still connecting")
+	}
+	if time.Now().Before(c.downUntil) {
+		return fmt.Errorf("redis: unavailable, retrying after %s: %v", c.downUntil.Format(time.RFC3339), c.dialErr)
 	}
 
-	album := items[0].(map[string]interface{})
-	albumID := album["id"].(string)
+	c.dialing = true
+	c.mu.Unlock()
+	conn, err := c.dial()
+	c.mu.Lock()
+	c.dialing = false
+	if err != nil {
+		c.downUntil = time.Now().Add(redisReconnectCooldown)
+		c.dialErr = err
+		return err
+	}
+	c.conn = conn
+	return nil
+}
 
-	albumData, err := client.makeRequest("GET", "/albums/"+albumID)
+// dial connects to Redis and selects the database.
+func (c *redisClient) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	conn := &redisConn{conn: netConn, rd: bufio.NewReader(netConn), timeout: c.timeout}
 
-	var albumResult map[string]interface{}
-	if err := json.Unmarshal(albumData, &albumResult); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args); err != nil {
+			netConn.Close()
+			return nil, err
+		}
 	}
+	return conn, nil
+}
 
-	response := AlbumResponse{
-		Success: true,
-		Album: AlbumInfo{
-			Name:        albumResult["name"].(string),
-			Artists:     getArtists(albumResult["artists"].([]interface{})),
-			ReleaseDate: albumResult["release_date"].(string),
-			TotalTracks: int(albumResult["total_tracks"].(float64)),
-			Popularity:  int(albumResult["popularity"].(float64)),
-			Type:        albumResult["album_type"].(string),
-			URL:         albumResult["external_urls"].(map[string]interface{})["spotify"].(string),
-			Images:      getImages(albumResult["images"].([]interface{})),
-			Tracks:      getTracks(albumResult["tracks"].(map[string]interface{})["items"].([]interface{})),
-		},
+// roundTrip writes one command and reads its reply.
+func (c *redisConn) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
 	}
+	return c.readReply()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
 }
 
-func formatDuration(ms int) string {
-	seconds := ms / 1000
-	minutes := seconds / 60
-	seconds = seconds % 60
-	return fmt.Sprintf("%d:%02d", minutes, seconds)
+// RateLimiter decides whether the client identified by key may make another
+// request. When it may not, retryAfter says when it can try again.
+type RateLimiter interface {
+	Allow(key string) (allowed bool, retryAfter time.Duration, err error)
 }
 
-func getArtistImage(artist map[string]interface{}) string {
-	images := artist["images"].([]interface{})
-	if len(images) > 0 {
-		return images[0].(map[string]interface{})["url"].(string)
-	}
-	return ""
+// memoryRateLimiter allows limit requests per key in each fixed window,
+// counted in this process only.
+type memoryRateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	current int64 // index of the window counts belongs to
+	counts  map[string]int
 }
 
-func getStringSlice(items []interface{}) []string {
-	result := make([]string, len(items))
-	for i, item := range items {
-		result[i] = item.(string)
+func newMemoryRateLimiter(limit int, window time.Duration) *memoryRateLimiter {
+	return &memoryRateLimiter{limit: limit, window: window, counts: make(map[string]int)}
+}
+
+func (l *memoryRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	index := now.UnixNano() / int64(l.window)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Windows are aligned for all keys, so a new window starts every count
+	// from zero.
+	if index != l.current {
+		l.current = index
+		l.counts = make(map[string]int)
 	}
-	return result
+	l.counts[key]++
+	return l.counts[key] <= l.limit, windowRemaining(now, l.window), nil
 }
 
-func getTopTracks(tracks []interface{}) []TopTrackInfo {
-	result := make([]TopTrackInfo, len(tracks))
-	for i, track := range tracks {
-		t := track.(map[string]interface{})
-		result[i] = TopTrackInfo{
-			Name:       t["name"].(string),
-			Popularity: int(t["popularity"].(float64)),
+// redisRateLimiter is memoryRateLimiter with the counts kept in Redis, so
+// that every instance sharing the Redis server enforces one global limit.
+type redisRateLimiter struct {
+	client *redisClient
+	limit  int
+	window time.Duration
+}
+
+func (l *redisRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := time.Now()
+	redisKey := fmt.Sprintf("spotify:ratelimit:%s:%d", key, now.UnixNano()/int64(l.window))
+
+	reply, err := l.client.do("INCR", redisKey)
+	if err != nil {
+		return false, 0, err
+	}
+	count, _ := reply.(int64)
+	if count == 1 {
+		if _, err := l.client.do("PEXPIRE", redisKey, strconv.FormatInt(int64(l.window/time.Millisecond), 10)); err != nil {
+			return false, 0, err
 		}
 	}
-	return result
+	return count <= int64(l.limit), windowRemaining(now, l.window), nil
 }
 
-func getAlbums(albums []interface{}) []AlbumBasicInfo {
-	result := make([]AlbumBasicInfo, len(albums))
-	for i, album := range albums {
-		a := album.(map[string]interface{})
-		result[i] = AlbumBasicInfo{
-			Name: a["name"].(string),
-			Type: a["album_type"].(string),
+// windowRemaining returns the time left in the fixed window containing now.
+func windowRemaining(now time.Time, window time.Duration) time.Duration {
+	return window - time.Duration(now.UnixNano()%int64(window))
+}
+
+// fallbackRateLimiter uses primary, switching to fallback for as long as
+// primary fails. Changes between the two are logged.
+type fallbackRateLimiter struct {
+	primary, fallback RateLimiter
+
+	mu       sync.Mutex
+	degraded bool
+}
+
+func (l *fallbackRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	allowed, retryAfter, err := l.primary.Allow(key)
+
+	l.mu.Lock()
+	if (err != nil) != l.degraded {
+		l.degraded = err != nil
+		if l.degraded {
+			fmt.Printf("Warning: shared rate limiter unavailable, using in-memory limits: %v\n", err)
+		} else {
+			fmt.Println("Shared rate limiter recovered")
 		}
 	}
-	return result
+	l.mu.Unlock()
+
+	if err != nil {
+		return l.fallback.Allow(key)
+	}
+	return allowed, retryAfter, nil
 }
 
-func getAlbumStats(albums []interface{}) AlbumStats {
-	var stats AlbumStats
-	for _, album := range albums {
-		a := album.(map[string]interface{})
-		switch a["album_type"].(string) {
-		case "album":
-			stats.Album++
-		case "single":
-			stats.Single++
-		case "compilation":
-			stats.Compilation++
+// rateLimitHandler rejects clients, identified by IP address, that exceed
+// limiter with 429 Too Many Requests.
+func rateLimitHandler(limiter RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			key = r.RemoteAddr
+		}
+
+		allowed, retryAfter, err := limiter.Allow(key)
+		if err == nil && !allowed {
+			// Round up so clients never retry before the window resets.
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			writeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded; try again later")
+			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// latencySampleSize is how many recent requests per endpoint the latency
+// percentiles are computed over.
+const latencySampleSize = 1024
+
+// latencyTracker keeps recent request durations for each endpoint.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples map[string]*latencySamples
+}
+
+// latencySamples is a ring buffer of durations.
+type latencySamples struct {
+	durations []time.Duration
+	next      int
+	count     int
+}
+
+var latencies = &latencyTracker{samples: make(map[string]*latencySamples)}
+
+func (t *latencyTracker) record(endpoint string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.samples[endpoint]
+	if !ok {
+		s = &latencySamples{}
+		t.samples[endpoint] = s
 	}
-	return stats
+	if len(s.durations) < latencySampleSize {
+		s.durations = append(s.durations, d)
+	} else {
+		s.durations[s.next] = d
+	}
+	s.next = (s.next + 1) % latencySampleSize
+	s.count++
 }
 
-func getArtists(artists []interface{}) []ArtistBasic {
-	result := make([]ArtistBasic, len(artists))
-	for i, artist := range artists {
-		a := artist.(map[string]interface{})
-		result[i] = ArtistBasic{
-			Name: a["name"].(string),
-			ID:   a["id"].(string),
-			URL:  a["external_urls"].(map[string]interface{})["spotify"].(string),
-		}
+// endpointLatency summarises the recent latency of one endpoint.
+type endpointLatency struct {
+	endpoint      string
+	count         int
+	p50, p95, p99 time.Duration
+}
+
+// percentiles returns the latency of every endpoint, sorted by endpoint.
+func (t *latencyTracker) percentiles() []endpointLatency {
+	t.mu.Lock()
+	result := make([]endpointLatency, 0, len(t.samples))
+	sorted := make(map[string][]time.Duration, len(t.samples))
+	for endpoint, s := range t.samples {
+		sorted[endpoint] = append([]time.Duration(nil), s.durations...)
+		result = append(result, endpointLatency{endpoint: endpoint, count: s.count})
+	}
+	t.mu.Unlock()
+
+	// Sort outside the lock so recording isn't held up.
+	for i := range result {
+		d := sorted[result[i].endpoint]
+		sort.Slice(d, func(a, b int) bool { return d[a] < d[b] })
+		result[i].p50 = d[len(d)*50/100]
+		result[i].p95 = d[len(d)*95/100]
+		result[i].p99 = d[len(d)*99/100]
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i].endpoint < result[j].endpoint })
 	return result
 }
 
-func getImages(images []interface{}) []ImageInfo {
-	result := make([]ImageInfo, len(images))
-	for i, image := range images {
-		img := image.(map[string]interface{})
-		result[i] = ImageInfo{
-			URL:    img["url"].(string),
-			Height: int(img["height"].(float64)),
-			Width:  int(img["width"].(float64)),
+// upstreamResultCounter counts Spotify API attempts, and the failed ones by
+// status code, so error rates can be graphed.
+type upstreamResultCounter struct {
+	mu       sync.Mutex
+	attempts int
+	errors   map[string]int
+}
+
+var upstreamResults = &upstreamResultCounter{errors: make(map[string]int)}
+
+// record counts an attempt with the given outcome. Failures are labelled by
+// status code, or "network_error" when no response arrived. A 304 from
+// revalidating a cached response is not a failure.
+func (c *upstreamResultCounter) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.attempts++
+	if err == nil {
+		return
+	}
+	label := "network_error"
+	if apiErr, ok := err.(*APIError); ok {
+		if apiErr.Status == http.StatusNotModified {
+			return
 		}
+		label = strconv.Itoa(apiErr.Status)
 	}
-	return result
+	c.errors[label]++
 }
 
-func getTracks(tracks []interface{}) []TrackBasic {
-	result := make([]TrackBasic, len(tracks))
-	for i, track := range tracks {
-		t := track.(map[string]interface{})
-		result[i] = TrackBasic{
-			Name:        t["name"].(string),
-			Duration:    int(t["duration_ms"].(float64)),
-			TrackNumber: int(t["track_number"].(float64)),
-			URL:         t["external_urls"].(map[string]interface{})["spotify"].(string),
+// upstreamErrorCount is the number of failed attempts with one label.
+type upstreamErrorCount struct {
+	status string
+	count  int
+}
+
+// snapshot returns the number of attempts and the failures per label, sorted
+// by label.
+func (c *upstreamResultCounter) snapshot() (int, []upstreamErrorCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make([]upstreamErrorCount, 0, len(c.errors))
+	for status, count := range c.errors {
+		counts = append(counts, upstreamErrorCount{status: status, count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].status < counts[j].status })
+	return c.attempts, counts
+}
+
+// upstreamCall is one Spotify API attempt made while serving a request.
+type upstreamCall struct {
+	endpoint string
+	duration time.Duration
+}
+
+// upstreamCalls collects the Spotify calls made for a request so slow
+// requests can be logged with their cause. stale records whether any of
+// them was answered from a stale cache entry, and cached whether any was
+// answered from the cache at all.
+type upstreamCalls struct {
+	mu     sync.Mutex
+	calls  []upstreamCall
+	stale  bool
+	cached bool
+}
+
+type contextKey int
+
+const upstreamCallsKey contextKey = iota
+
+// recordUpstreamCall notes a Spotify call on the request context, if the
+// request is being tracked.
+func recordUpstreamCall(ctx context.Context, endpoint string, d time.Duration) {
+	calls, ok := ctx.Value(upstreamCallsKey).(*upstreamCalls)
+	if !ok {
+		return
+	}
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	calls.calls = append(calls.calls, upstreamCall{endpoint: endpoint, duration: d})
+}
+
+// markServedStale notes on the request context that a stale cache entry was
+// used, if the request is being tracked.
+func markServedStale(ctx context.Context) {
+	calls, ok := ctx.Value(upstreamCallsKey).(*upstreamCalls)
+	if !ok {
+		return
+	}
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	calls.stale = true
+	calls.cached = true
+}
+
+// markServedFromCache notes on the request context that a cached response or
+// computed result was used, if the request is being tracked.
+func markServedFromCache(ctx context.Context) {
+	calls, ok := ctx.Value(upstreamCallsKey).(*upstreamCalls)
+	if !ok {
+		return
+	}
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	calls.cached = true
+}
+
+// servedStale reports whether markServedStale was called for the request.
+func servedStale(ctx context.Context) bool {
+	calls, ok := ctx.Value(upstreamCallsKey).(*upstreamCalls)
+	if !ok {
+		return false
+	}
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	return calls.stale
+}
+
+// dataSource describes where the data for a request came from: "cache" when
+// everything was served from the cache, "upstream" when everything came from
+// Spotify, "mixed" for both and "" when neither was used, as for validation
+// errors.
+func dataSource(ctx context.Context) string {
+	calls, ok := ctx.Value(upstreamCallsKey).(*upstreamCalls)
+	if !ok {
+		return ""
+	}
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	switch {
+	case calls.cached && len(calls.calls) > 0:
+		return "mixed"
+	case calls.cached:
+		return "cache"
+	case len(calls.calls) > 0:
+		return "upstream"
+	}
+	return ""
+}
+
+// slowRequestThreshold is the duration above which requests are logged
+// along with their slowest Spotify calls. 0 disables logging.
+var slowRequestThreshold = 2 * time.Second
+
+// latencyHandler records how long each request to an endpoint registered on
+// mux takes, and logs requests slower than slowRequestThreshold.
+func latencyHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		calls := &upstreamCalls{}
+		r = r.WithContext(context.WithValue(r.Context(), upstreamCallsKey, calls))
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		elapsed := time.Since(start)
+
+		latencies.record(pattern, elapsed)
+		if slowRequestThreshold > 0 && elapsed > slowRequestThreshold {
+			logSlowRequest(r, elapsed, calls)
+		}
+	})
+}
+
+// logSlowRequest logs a slow request with its five slowest Spotify calls.
+func logSlowRequest(r *http.Request, elapsed time.Duration, calls *upstreamCalls) {
+	calls.mu.Lock()
+	sorted := append([]upstreamCall(nil), calls.calls...)
+	calls.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].duration > sorted[j].duration })
+	if len(sorted) > 5 {
+		sorted = sorted[:5]
+	}
+
+	slowest := "none"
+	if len(sorted) > 0 {
+		names := make([]string, len(sorted))
+		for i, call := range sorted {
+			names[i] = fmt.Sprintf("%s (%v)", call.endpoint, call.duration.Round(time.Millisecond))
 		}
+		slowest = strings.Join(names, ", ")
 	}
-	return result
+	fmt.Printf("Slow request: %s %s took %v; slowest Spotify calls: %s\n",
+		r.Method, r.URL.RequestURI(), elapsed.Round(time.Millisecond), slowest)
+}
+
+// version identifies the build in the X-Spotify-Info-Version header and
+// the meta.version field of v2 responses. Release builds set it with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// versionHandler adds the X-Spotify-Info-Version header to every response.
+func versionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Spotify-Info-Version", version)
+		next.ServeHTTP(w, r)
+	})
 }
 
+// clientID and clientSecret are the Spotify app credentials. The
+// SPOTIFY_CLIENT_ID and SPOTIFY_CLIENT_SECRET environment variables override
+// them.
 var (
 	clientID     = ""
 	clientSecret = ""
 )
 
+var (
+	// defaultMarket is used when a request names no market.
+	defaultMarket = ""
+	// marketFromLanguage enables inferring a request's market from its
+	// Accept-Language header before falling back to defaultMarket.
+	marketFromLanguage = false
+)
+
+// redirectURI must match a redirect URI registered for the Spotify app.
+var redirectURI = "http://localhost:8080/spotify/callback"
+
+// spotifyClient is shared by all handlers so the access token is reused
+// across requests.
+var spotifyClient *SpotifyClient
+
 func main() {
+	warmup := flag.Bool("warmup", true, "authenticate with Spotify before accepting traffic")
+	checkAuth := flag.Bool("check-auth", false, "authenticate with Spotify once, report the result and exit without serving")
+	maxRetries := flag.Int("max-retries", 3, "retries for rate-limited or failed Spotify requests")
+	authRetries := flag.Int("auth-retries", 5, "retries for token requests that are rate limited, fail with 5xx or hit a network error")
+	maxRetryWait := flag.Duration("retry-max-wait", 30*time.Second, "maximum wait between retries")
+	flag.StringVar(&redirectURI, "redirect-uri", redirectURI, "OAuth redirect URI registered for the Spotify app")
+	flag.StringVar(&defaultMarket, "default-market", defaultMarket, "market used when a request names none")
+	flag.BoolVar(&userMarketFromToken, "user-market-from-token", userMarketFromToken, "use the logged-in user's market on /spotify/me/ endpoints when a request names none")
+	flag.BoolVar(&marketFromLanguage, "market-from-language", marketFromLanguage, "infer the market from Accept-Language when a request names none")
+	flag.BoolVar(&trackAlbums, "track-albums", trackAlbums, "include each track's album when a track request doesn't set album")
+	flag.DurationVar(&latestReleaseTTL, "latest-ttl", latestReleaseTTL, "how long /spotify/artist/latest caches an artist's latest release")
+	flag.IntVar(&maxConcurrency, "max-concurrency", maxConcurrency, "maximum concurrent Spotify calls per request")
+	gzipLevel := flag.Int("gzip-level", 6, "gzip compression level, 1 (fastest) to 9 (smallest)")
+	cacheTTL := flag.Duration("cache-ttl", 5*time.Minute, "how long catalog responses are cached (0 disables caching)")
+	staleTimeout := flag.Duration("stale-timeout", 0, "serve a stale cached response when revalidating it takes longer than this (0 disables)")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "maximum size of JSON request bodies in bytes")
+	cacheMaxBytes := flag.Int("cache-max-bytes", 64<<20, "maximum total size of cached responses in bytes")
+	flag.StringVar(&adminKey, "admin-key", os.Getenv("ADMIN_KEY"), "key required by the /admin/ endpoints, which are disabled when empty")
+	flag.DurationVar(&slowRequestThreshold, "slow-request", slowRequestThreshold, "log requests slower than this, with their slowest Spotify calls (0 disables)")
+	flag.StringVar(&webhookSecret, "webhook-secret", os.Getenv("WEBHOOK_SECRET"), "secret used to sign release webhooks; /watch/artist is disabled when empty")
+	watchInterval := flag.Duration("watch-interval", time.Hour, "how often watched artists are checked for new releases")
+	watchFile := flag.String("watch-file", "watches.json", "file artist watches are saved in when REDIS_URL is not set (empty keeps them in memory)")
+	rateLimit := flag.Int("rate-limit", 0, "requests allowed per client IP in each -rate-window (0 disables rate limiting)")
+	rateWindow := flag.Duration("rate-window", time.Minute, "window over which -rate-limit is counted")
+	allowedOrigins := flag.String("allowed-origins", "", "comma-separated origins allowed to call the API from browsers")
+	allowedOriginPattern := flag.String("allowed-origin-pattern", "", "regular expression for further allowed origins; must match the whole origin")
+	breakerThreshold := flag.Int("breaker-threshold", 5, "consecutive Spotify failures that open the circuit breaker (0 disables it)")
+	rawTimeBudgets := flag.String("time-budgets", "", "comma-separated path=duration time budgets for endpoints making many Spotify calls, with * for the rest")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "maximum time to read a request, including its body (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 2*time.Minute, "maximum time from the end of reading a request's headers to the end of writing its response (0 disables)")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is kept open (0 uses -read-timeout)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "maximum time to read a request's headers (0 uses -read-timeout)")
+	keepAlives := flag.Bool("keep-alives", true, "reuse connections for several requests")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; with -tls-key, serves HTTPS and HTTP/2")
+	tlsKey := flag.String("tls-key", "", "TLS private key file for -tls-cert")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "how long the circuit breaker stays open before probing Spotify")
+	flag.Parse()
+
+	defaultMarket = strings.ToUpper(defaultMarket)
+	if defaultMarket != "" && !marketPattern.MatchString(defaultMarket) {
+		fmt.Printf("Invalid -default-market %q: must be a two-letter ISO 3166-1 country code\n", defaultMarket)
+		os.Exit(1)
+	}
+	if maxConcurrency < 1 {
+		fmt.Printf("Invalid -max-concurrency %d: must be at least 1\n", maxConcurrency)
+		os.Exit(1)
+	}
+	prefetchSlots = make(chan struct{}, maxConcurrency)
+	if *cacheMaxBytes < 1 {
+		fmt.Printf("Invalid -cache-max-bytes %d: must be at least 1\n", *cacheMaxBytes)
+		os.Exit(1)
+	}
+	if maxBodyBytes < 1 {
+		fmt.Printf("Invalid -max-body-bytes %d: must be at least 1\n", maxBodyBytes)
+		os.Exit(1)
+	}
+	for name, timeout := range map[string]time.Duration{
+		"-read-timeout":        *readTimeout,
+		"-write-timeout":       *writeTimeout,
+		"-idle-timeout":        *idleTimeout,
+		"-read-header-timeout": *readHeaderTimeout,
+	} {
+		if timeout < 0 {
+			fmt.Printf("Invalid %s %v: must not be negative\n", name, timeout)
+			os.Exit(1)
+		}
+	}
+	var err error
+	if timeBudgets, err = parseTimeBudgets(*rawTimeBudgets); err != nil {
+		fmt.Printf("Invalid -time-budgets: %v\n", err)
+		os.Exit(1)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fmt.Println("Invalid TLS configuration: -tls-cert and -tls-key must be set together")
+		os.Exit(1)
+	}
+	if latestReleaseTTL <= 0 {
+		fmt.Printf("Invalid -latest-ttl %v: must be positive\n", latestReleaseTTL)
+		os.Exit(1)
+	}
+	if *rateLimit > 0 && *rateWindow < time.Second {
+		fmt.Printf("Invalid -rate-window %v: must be at least 1s\n", *rateWindow)
+		os.Exit(1)
+	}
+	if webhookSecret != "" && adminKey == "" {
+		fmt.Printf("Invalid -webhook-secret: /watch/artist also needs -admin-key\n")
+		os.Exit(1)
+	}
+	if *watchInterval < time.Minute {
+		fmt.Printf("Invalid -watch-interval %v: must be at least 1m\n", *watchInterval)
+		os.Exit(1)
+	}
+	for name, retries := range map[string]int{
+		"-max-retries":  *maxRetries,
+		"-auth-retries": *authRetries,
+	} {
+		if retries < 0 || retries > maxRetriesLimit {
+			fmt.Printf("Invalid %s %d: must be between 0 and %d\n", name, retries, maxRetriesLimit)
+			os.Exit(1)
+		}
+	}
+	if *gzipLevel < gzip.BestSpeed || *gzipLevel > gzip.BestCompression {
+		fmt.Printf("Invalid -gzip-level %d: must be between %d and %d\n", *gzipLevel, gzip.BestSpeed, gzip.BestCompression)
+		os.Exit(1)
+	}
+	cors, err := newCORSPolicy(*allowedOrigins, *allowedOriginPattern)
+	if err != nil {
+		fmt.Printf("Invalid -allowed-origin-pattern %q: %v\n", *allowedOriginPattern, err)
+		os.Exit(1)
+	}
+
+	for name, timeout := range map[string]*time.Duration{
+		"SPOTIFY_DIAL_TIMEOUT":            &dialTimeout,
+		"SPOTIFY_TLS_HANDSHAKE_TIMEOUT":   &tlsHandshakeTimeout,
+		"SPOTIFY_RESPONSE_HEADER_TIMEOUT": &responseHeaderTimeout,
+		"SPOTIFY_REQUEST_TIMEOUT":         &requestTimeout,
+		"SPOTIFY_AUTH_TIMEOUT":            &authTimeout,
+	} {
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			fmt.Printf("Invalid %s %q: must be a positive duration such as 5s\n", name, raw)
+			os.Exit(1)
+		}
+		*timeout = d
+	}
+
+	if id := os.Getenv("SPOTIFY_CLIENT_ID"); id != "" {
+		clientID = id
+	}
+	if secret := os.Getenv("SPOTIFY_CLIENT_SECRET"); secret != "" {
+		clientSecret = secret
+	}
+
+	var credentials *credentialPool
+	if raw := os.Getenv("SPOTIFY_CREDENTIALS"); raw != "" {
+		var err error
+		if credentials, err = parseCredentials(raw); err != nil {
+			fmt.Printf("Invalid SPOTIFY_CREDENTIALS: %v\n", err)
+			os.Exit(1)
+		}
+		// Log users in with the first app when none is set in the code.
+		if clientID == "" {
+			clientID = credentials.creds[0].clientID
+			clientSecret = credentials.creds[0].clientSecret
+		}
+	}
+	// Without credentials every request would fail with an opaque error from
+	// Spotify, so refuse to start instead.
+	if clientID == "" {
+		fmt.Println("SPOTIFY_CLIENT_ID is required: set it in the environment or clientID in spotify.go")
+		os.Exit(1)
+	}
+	if clientSecret == "" {
+		fmt.Println("SPOTIFY_CLIENT_SECRET is required: set it in the environment or clientSecret in spotify.go")
+		os.Exit(1)
+	}
+
+	spotifyClient = NewSpotifyClient(clientID, clientSecret)
+	spotifyClient.Credentials = credentials
+	spotifyClient.MaxRetries = *maxRetries
+	spotifyClient.MaxRetryWait = *maxRetryWait
+	spotifyClient.AuthRetries = *authRetries
+	if *breakerThreshold > 0 {
+		spotifyClient.Breaker = newCircuitBreaker(*breakerThreshold, *breakerCooldown)
+	}
+	if *checkAuth {
+		if err := checkCredentials(spotifyClient); err != nil {
+			fmt.Printf("Credential check failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *warmup {
+		var err error
+		if credentials != nil {
+			err = credentials.authenticateAll(context.Background(), spotifyClient)
+		} else {
+			_, err = spotifyClient.validToken(context.Background())
+		}
+		if err != nil {
+			fmt.Printf("Warmup failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	http.HandleFunc("/metrics", handleMetrics)
+	if adminKey != "" {
+		http.HandleFunc("/admin/cache", requireAdmin(handleAdminCache))
+	}
+	http.HandleFunc("/spotify/capabilities", handleCapabilities)
 	http.HandleFunc("/spotify/songs", handleSpotifySongs)
 	http.HandleFunc("/spotify/artist/short", handleArtistShort)
 	http.HandleFunc("/spotify/artist/full", handleArtistFull)
+	http.HandleFunc("/spotify/artist/stats", handleArtistStats)
+	http.HandleFunc("/spotify/artist/appears-on", handleAppearsOn)
+	http.HandleFunc("/spotify/artist/track-count", handleArtistTrackCount)
+	http.HandleFunc("/spotify/artist/export", handleArtistExport)
+	http.HandleFunc("/spotify/artist/latest", handleArtistLatest)
+	http.HandleFunc("/spotify/artist/genres", handleArtistGenres)
+	http.HandleFunc("/spotify/artist/similar", handleSimilarArtists)
+	http.HandleFunc("/spotify/artists/top-tracks", handleArtistsTopTracks)
 	http.HandleFunc("/spotify/album", handleAlbum)
+	http.HandleFunc("/spotify/album/upc", handleAlbumEditions)
+	http.HandleFunc("/spotify/album/more", handleMoreAlbums)
+	http.HandleFunc("/spotify/track/similar", handleSimilarTracks)
+	http.HandleFunc("/spotify/track/album", handleTrackAlbum)
+	http.HandleFunc("/spotify/track/artists", handleTrackArtists)
+	http.HandleFunc("/spotify/tracks", handleTracks)
+	http.HandleFunc("/spotify/tracks/isrc", handleISRCTracks)
+	http.HandleFunc("/spotify/track/markets", handleTrackMarkets)
+	http.HandleFunc("/spotify/episodes", handleEpisodes)
+	http.HandleFunc("/spotify/shows", handleShows)
+	http.HandleFunc("/spotify/audiobook/chapters", handleAudiobookChapters)
+	http.HandleFunc("/spotify/playlist", handlePlaylist)
+	http.HandleFunc("/spotify/playlist/image", handlePlaylistImage)
+	http.HandleFunc("/spotify/user", handleUser)
+	http.HandleFunc("/spotify/playlists/diff", handlePlaylistDiff)
+	http.HandleFunc("/spotify/playlist/duplicates", handlePlaylistDuplicates)
+	http.HandleFunc("/spotify/playlists/merge", handlePlaylistMerge)
+	http.HandleFunc("/spotify/page", handlePage)
+	http.HandleFunc("/spotify/resolve", handleResolve)
+	http.HandleFunc("/spotify/resolve/batch", handleResolveBatch)
+	http.HandleFunc("/spotify/normalize-ids", handleNormalizeIDs)
+	http.HandleFunc("/spotify/search/count", handleSearchCount)
+	http.HandleFunc("/spotify/search/ranked", handleSearchRanked)
+	http.HandleFunc("/spotify/search/fields", handleSearchFields)
+	http.HandleFunc("/spotify/login", handleLogin)
+	http.HandleFunc("/spotify/callback", handleCallback)
+	http.HandleFunc("/spotify/me/following", handleFollowing)
+	http.HandleFunc("/spotify/me/following/contains", handleFollowingContains)
+	http.HandleFunc("/spotify/me/playlists", handleCreatePlaylist)
+	http.HandleFunc("/spotify/me/recommendations", handleRecommendations)
+	http.HandleFunc("/spotify/me/albums", handleSavedAlbums)
+	http.HandleFunc("/spotify/me/player/context", handlePlayerContext)
+	http.HandleFunc("/spotify/me/player/queue", handlePlaybackQueue)
+	http.HandleFunc("/spotify/me/player/devices", handleDevices)
+	http.HandleFunc("/spotify/me/player/play", playbackCommand(http.MethodPut, "play"))
+	http.HandleFunc("/spotify/me/player/pause", playbackCommand(http.MethodPut, "pause"))
+	http.HandleFunc("/spotify/me/player/next", playbackCommand(http.MethodPost, "next"))
+	http.HandleFunc("/spotify/me/player/previous", playbackCommand(http.MethodPost, "previous"))
+	http.HandleFunc("/spotify/playlist/tracks", handleAddTracks)
+
+	var redis *redisClient
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		var err error
+		if redis, err = newRedisClient(redisURL); err != nil {
+			fmt.Printf("Invalid REDIS_URL: %v\n", err)
+			os.Exit(1)
+		}
+		if _, err := redis.do("PING"); err != nil {
+			fmt.Printf("Warning: Redis unreachable, shared state falls back to memory until it recovers: %v\n", err)
+		}
+	}
+
+	if webhookSecret != "" {
+		switch {
+		case redis != nil:
+			watches = &redisWatchStore{client: redis}
+		case *watchFile != "":
+			if watches, err = newFileWatchStore(*watchFile); err != nil {
+				fmt.Printf("Invalid -watch-file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		http.HandleFunc("/watch/artist", requireAdmin(handleWatchArtist))
+		go pollWatches(context.Background(), *watchInterval)
+	}
+
+	if *cacheTTL > 0 {
+		spotifyClient.CacheTTL = *cacheTTL
+		spotifyClient.StaleTimeout = *staleTimeout
+		spotifyClient.Cache = newResponseCache(*cacheMaxBytes)
+		if redis != nil {
+			spotifyClient.Cache = &fallbackCache{
+				redis:    &redisCache{client: redis},
+				fallback: newResponseCache(*cacheMaxBytes),
+			}
+		}
+	}
 
-	fmt.Println("Starting server on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	var handler http.Handler = gzipHandler(http.DefaultServeMux, *gzipLevel)
+	if *rateLimit > 0 {
+		var limiter RateLimiter = newMemoryRateLimiter(*rateLimit, *rateWindow)
+		if redis != nil {
+			limiter = &fallbackRateLimiter{
+				primary:  &redisRateLimiter{client: redis, limit: *rateLimit, window: *rateWindow},
+				fallback: limiter,
+			}
+		}
+		handler = rateLimitHandler(limiter, handler)
+	}
+	if *allowedOrigins != "" || *allowedOriginPattern != "" {
+		handler = corsHandler(cors, handler)
+	}
+	handler = latencyHandler(http.DefaultServeMux, versionHandler(durationFormatHandler(handler)))
+
+	// Without timeouts a client that sends its request slowly, or never
+	// reads the response, holds its connection open indefinitely. Headers
+	// get their own short timeout, as slowloris attacks trickle them in to
+	// tie up connections before any handler runs.
+	server := &http.Server{
+		Addr:              ":8080",
+		Handler:           handler,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	server.SetKeepAlivesEnabled(*keepAlives)
+
+	if *tlsCert != "" {
+		// net/http negotiates HTTP/2 over TLS by itself.
+		fmt.Printf("Starting server %s on :8080 with TLS...\n", version)
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		fmt.Printf("Starting server %s on :8080...\n", version)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		fmt.Printf("Server error: %v\n", err)
 	}
 }
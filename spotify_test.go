@@ -0,0 +1,1286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTransport sends every request to a test server, keeping its path and
+// query, so the client's hardcoded Spotify URLs reach the mock.
+type testTransport struct {
+	target *url.URL
+}
+
+func (t testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// testToken is a token response from the accounts service.
+const testToken = `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`
+
+// mockSpotify starts a server answering the Web API under /v1 and the
+// accounts service at /api/token with routes, and returns a client that
+// calls it. Token requests succeed unless routes handle /api/token. The
+// client doesn't retry failed calls.
+func mockSpotify(t *testing.T, routes map[string]http.HandlerFunc) *SpotifyClient {
+	t.Helper()
+	mux := http.NewServeMux()
+	if _, ok := routes["/api/token"]; !ok {
+		mux.HandleFunc("/api/token", serveJSON(testToken))
+	}
+	for pattern, handler := range routes {
+		mux.HandleFunc(pattern, handler)
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewSpotifyClient("test-id", "test-secret")
+	client.HTTPClient = &http.Client{Transport: testTransport{target: target}}
+	client.MaxRetries = 0
+	return client
+}
+
+// useClient makes client the shared spotifyClient for the rest of the test.
+func useClient(t *testing.T, client *SpotifyClient) {
+	previous := spotifyClient
+	spotifyClient = client
+	t.Cleanup(func() { spotifyClient = previous })
+}
+
+// serveJSON answers every request with body.
+func serveJSON(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}
+}
+
+// rendezvous returns a wait for n requests to call, each returning once all
+// n have called it. A call that waits more than a second fails the test, so
+// requests made one at a time are caught.
+func rendezvous(t *testing.T, n int) func() {
+	var mu sync.Mutex
+	arrived := 0
+	all := make(chan struct{})
+	return func() {
+		mu.Lock()
+		if arrived++; arrived == n {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			t.Errorf("only %d of %d requests were in flight at once", arrived, n)
+		}
+	}
+}
+
+// get calls handler with a GET request for target and decodes its JSON
+// response into v, returning the status.
+func get(t *testing.T, handler http.HandlerFunc, target string, v interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: decoding %q: %v", target, recorder.Body.String(), err)
+	}
+	return recorder.Code
+}
+
+// serveError answers every request with a Spotify error of the given status.
+func serveError(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"status":` + strconv.Itoa(status) + `,"message":"` + http.StatusText(status) + `"}}`))
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter time.Duration
+		max        time.Duration
+		min, upper time.Duration
+	}{
+		{"first retry", 0, 0, time.Minute, 500 * time.Millisecond, 750 * time.Millisecond},
+		{"exponential", 3, 0, time.Minute, 4 * time.Second, 6 * time.Second},
+		{"retry after", 0, 2 * time.Second, time.Minute, 2 * time.Second, 3 * time.Second},
+		{"retry after ignores attempt", 5, 2 * time.Second, time.Minute, 2 * time.Second, 3 * time.Second},
+		{"capped", 10, 0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"retry after capped", 0, time.Hour, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"jitter straddles cap", 2, 0, 2500 * time.Millisecond, 2 * time.Second, 2500 * time.Millisecond},
+		// Shifting the base delay this far would overflow.
+		{"attempt 35", 35, 0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"attempt 40", 40, 0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"attempt 64", 64, 0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"attempt 1000", 1000, 0, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"large attempt with a day's cap", 100, 0, 24 * time.Hour, 24 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 1000; i++ {
+				wait := jitteredBackoff(tt.attempt, tt.retryAfter, tt.max)
+				if wait < tt.min || wait > tt.upper {
+					t.Fatalf("jitteredBackoff(%d, %v, %v) = %v, want within [%v, %v]", tt.attempt, tt.retryAfter, tt.max, wait, tt.min, tt.upper)
+				}
+				seen[wait] = true
+			}
+			// Without jitter every client would retry at the same instant.
+			if tt.min != tt.upper && len(seen) < 2 {
+				t.Errorf("jitteredBackoff(%d, %v, %v) always returned %v", tt.attempt, tt.retryAfter, tt.max, tt.min)
+			}
+		})
+	}
+}
+
+func TestBackoffUsesMaxRetryWait(t *testing.T) {
+	client := &SpotifyClient{MaxRetryWait: time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		if wait := client.backoff(attempt, 0); wait > time.Second {
+			t.Fatalf("backoff(%d, 0) = %v, want at most MaxRetryWait %v", attempt, wait, time.Second)
+		}
+	}
+}
+
+func TestSearchFirst(t *testing.T) {
+	tests := []struct {
+		name       string
+		searchType string
+		response   http.HandlerFunc
+		wantName   string
+		wantErr    string
+		notFound   bool
+	}{
+		{"first result", "artist", serveJSON(`{"artists":{"items":[{"id":"a","name":"The Weeknd"},{"id":"b","name":"Other"}]}}`), "The Weeknd", "", false},
+		{"null entries skipped", "artist", serveJSON(`{"artists":{"items":[null,{"id":"a","name":"The Weeknd"}]}}`), "The Weeknd", "", false},
+		{"no artists", "artist", serveJSON(`{"artists":{"items":[]}}`), "", "No artist found", true},
+		{"no tracks", "track", serveJSON(`{"tracks":{"items":[]}}`), "", "No tracks found", true},
+		{"only nulls", "album", serveJSON(`{"albums":{"items":[null]}}`), "", "No album found", true},
+		{"upstream error", "artist", serveError(http.StatusBadGateway), "", "spotify api error (502): Bad Gateway", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query url.Values
+			client := mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/search": func(w http.ResponseWriter, r *http.Request) {
+					query = r.URL.Query()
+					tt.response(w, r)
+				},
+			})
+
+			var item struct {
+				Name string `json:"name"`
+			}
+			err := searchFirst(context.Background(), client, "the weeknd", tt.searchType, "SE", &item)
+			want := url.Values{"q": {"the weeknd"}, "type": {tt.searchType}, "limit": {"1"}, "market": {"SE"}}
+			if query.Encode() != want.Encode() {
+				t.Errorf("searched with %v, want %v", query, want)
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("searchFirst() error = %v, want %q", err, tt.wantErr)
+				}
+				var notFound *NotFoundError
+				if errors.As(err, &notFound) != tt.notFound {
+					t.Errorf("searchFirst() error is %T, want NotFoundError: %v", err, tt.notFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("searchFirst() error = %v", err)
+			}
+			if item.Name != tt.wantName {
+				t.Errorf("searchFirst() decoded %q, want %q", item.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestArtistFullFetchesConcurrently(t *testing.T) {
+	const artistID = "1Xyo4u8uXC1ZmMpatF05PJ"
+	topTracks := serveJSON(`{"tracks":[{"id":"t1","name":"Blinding Lights","popularity":94}]}`)
+	albums := serveJSON(`{"items":[{"id":"a1","name":"After Hours","album_type":"album"}],"total":1}`)
+	tests := []struct {
+		name         string
+		topTracks    http.HandlerFunc
+		albums       http.HandlerFunc
+		status       int
+		wantTracks   int
+		wantAlbums   int
+		wantWarnings int
+	}{
+		{"both succeed", topTracks, albums, http.StatusOK, 1, 1, 0},
+		{"top tracks fail", serveError(http.StatusInternalServerError), albums, http.StatusOK, 0, 1, 1},
+		{"albums fail", topTracks, serveError(http.StatusInternalServerError), http.StatusOK, 1, 0, 1},
+		{"both fail", serveError(http.StatusInternalServerError), serveError(http.StatusInternalServerError), http.StatusBadGateway, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait := rendezvous(t, 2)
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/search": serveJSON(`{"artists":{"items":[{"id":"` + artistID + `","name":"The Weeknd"}]}}`),
+				"/v1/artists/" + artistID + "/top-tracks": func(w http.ResponseWriter, r *http.Request) {
+					wait()
+					tt.topTracks(w, r)
+				},
+				"/v1/artists/" + artistID + "/albums": func(w http.ResponseWriter, r *http.Request) {
+					wait()
+					tt.albums(w, r)
+				},
+			}))
+
+			var response ArtistFullResponse
+			status := get(t, handleArtistFull, "/spotify/artist/full?q=weeknd", &response)
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if len(response.Artist.TopTracks) != tt.wantTracks || len(response.Artist.Albums) != tt.wantAlbums {
+				t.Errorf("got %d top tracks and %d albums, want %d and %d", len(response.Artist.TopTracks), len(response.Artist.Albums), tt.wantTracks, tt.wantAlbums)
+			}
+			if len(response.Warnings) != tt.wantWarnings || response.Partial != (tt.wantWarnings > 0) {
+				t.Errorf("partial = %v with warnings %q, want %d warnings", response.Partial, response.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestLargeFollowerCounts(t *testing.T) {
+	// 2^53 + 1 is the smallest integer a float64 can't hold.
+	const followers = "9007199254740993"
+	const artistID = "1Xyo4u8uXC1ZmMpatF05PJ"
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"plain", "/spotify/artist/short?q=weeknd"},
+		{"duration format", "/spotify/artist/short?q=weeknd&duration_format=iso8601"},
+		{"v2 envelope", "/spotify/artist/short?q=weeknd&envelope=v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/search":                          serveJSON(`{"artists":{"items":[{"id":"` + artistID + `","name":"The Weeknd","followers":{"total":` + followers + `}}]}}`),
+				"/v1/artists/" + artistID + "/albums": serveJSON(`{"items":[]}`),
+			}))
+
+			var body json.RawMessage
+			if status := get(t, handleArtistShort, tt.target, &body); status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, body)
+			}
+			if !strings.Contains(string(body), `"followers":`+followers) {
+				t.Errorf("response %s doesn't have followers %s", body, followers)
+			}
+		})
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		raw     string
+		wantIDs []string
+	}{
+		{"a:1", []string{"a"}},
+		{"a:1, b:2,c:3", []string{"a", "b", "c"}},
+		{"a:se:cret", []string{"a"}},
+		{"a", nil},
+		{"a:", nil},
+		{":1", nil},
+		{"a:1,,b:2", nil},
+	}
+	for _, tt := range tests {
+		pool, err := parseCredentials(tt.raw)
+		if tt.wantIDs == nil {
+			if err == nil {
+				t.Errorf("parseCredentials(%q) succeeded, want an error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCredentials(%q) error = %v", tt.raw, err)
+			continue
+		}
+		var ids []string
+		for _, cred := range pool.creds {
+			ids = append(ids, cred.clientID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+			t.Errorf("parseCredentials(%q) = %v, want %v", tt.raw, ids, tt.wantIDs)
+		}
+	}
+}
+
+func TestCredentialRotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		rateLimited map[string]bool
+		calls       int
+		wantUsed    string
+		wantErr     bool
+	}{
+		{"round robin", nil, 6, "a,b,c,a,b,c", false},
+		{"rate limited credential skipped", map[string]bool{"a": true}, 4, "a,b,c,b,c", false},
+		{"all rate limited", map[string]bool{"a": true, "b": true, "c": true}, 1, "a,b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var used []string
+			tokenRequests := make(map[string]int)
+			client := mockSpotify(t, map[string]http.HandlerFunc{
+				"/api/token": func(w http.ResponseWriter, r *http.Request) {
+					clientID, _, _ := r.BasicAuth()
+					mu.Lock()
+					tokenRequests[clientID]++
+					mu.Unlock()
+					serveJSON(`{"access_token":"token-`+clientID+`","token_type":"Bearer","expires_in":3600}`)(w, r)
+				},
+				"/v1/tracks/": func(w http.ResponseWriter, r *http.Request) {
+					clientID := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token-")
+					mu.Lock()
+					used = append(used, clientID)
+					mu.Unlock()
+					if tt.rateLimited[clientID] {
+						w.Header().Set("Retry-After", "60")
+						serveError(http.StatusTooManyRequests)(w, r)
+						return
+					}
+					serveJSON(`{"id":"t1"}`)(w, r)
+				},
+			})
+			pool, err := parseCredentials("a:1,b:2,c:3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Credentials = pool
+			client.MaxRetries = 1
+			client.MaxRetryWait = 10 * time.Millisecond
+
+			for i := 0; i < tt.calls; i++ {
+				_, err := client.get(context.Background(), "/tracks/t1")
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("call %d: error = %v, want error: %v", i, err, tt.wantErr)
+				}
+			}
+			if got := strings.Join(used, ","); got != tt.wantUsed {
+				t.Errorf("credentials used %s, want %s", got, tt.wantUsed)
+			}
+			for clientID, n := range tokenRequests {
+				if n != 1 {
+					t.Errorf("client %s requested %d tokens, want 1", clientID, n)
+				}
+			}
+		})
+	}
+}
+
+func TestRestrictedEndpointResponse(t *testing.T) {
+	tests := []struct {
+		endpoint   string
+		restricted bool
+	}{
+		{"/audio-features/11dFghVXANMlKmJXsNCbNl", true},
+		{"/audio-features?ids=11dFghVXANMlKmJXsNCbNl", true},
+		{"/audio-analysis/11dFghVXANMlKmJXsNCbNl", true},
+		{"/recommendations?seed_tracks=11dFghVXANMlKmJXsNCbNl", true},
+		{"/artists/0TnOYISbd1XYRBk9myaseg/related-artists", true},
+		{"/browse/featured-playlists", true},
+		{"/browse/categories/pop/playlists", true},
+		{"/tracks/11dFghVXANMlKmJXsNCbNl", false},
+		{"/me/top/tracks", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			client := mockSpotify(t, map[string]http.HandlerFunc{"/v1/": serveError(http.StatusForbidden)})
+			_, err := client.get(context.Background(), tt.endpoint)
+			var restricted *RestrictedEndpointError
+			if errors.As(err, &restricted) != tt.restricted {
+				t.Fatalf("error = %v, want restricted: %v", err, tt.restricted)
+			}
+			if tt.restricted && restricted.Endpoint != strings.SplitN(tt.endpoint, "?", 2)[0] {
+				t.Errorf("Endpoint = %q, want it without the query", restricted.Endpoint)
+			}
+
+			for _, envelope := range []string{"", "v2"} {
+				recorder := httptest.NewRecorder()
+				writeUpstreamError(recorder, httptest.NewRequest(http.MethodGet, "/spotify/test?envelope="+envelope, nil), err)
+				if recorder.Code != http.StatusForbidden {
+					t.Errorf("envelope %q: status = %d, want 403", envelope, recorder.Code)
+				}
+				var response struct {
+					Success bool   `json:"success"`
+					Message string `json:"message"`
+					Error   struct {
+						Message string `json:"message"`
+					} `json:"error"`
+				}
+				if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				message := response.Message
+				if envelope == "v2" {
+					message = response.Error.Message
+				}
+				if response.Success || strings.HasPrefix(message, "this endpoint is restricted for your app") != tt.restricted {
+					t.Errorf("envelope %q: response %s", envelope, recorder.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestTracksKeepOrderAroundNulls(t *testing.T) {
+	const (
+		idA = "11dFghVXANMlKmJXsNCbNl"
+		idB = "0VjIjW4GlUZAMYd2vXMi3b"
+		idC = "7qiZfU4dY1lWllzX7mPBI3"
+	)
+	track := func(id string) string { return `{"id":"` + id + `","name":"Track ` + id + `"}` }
+	tests := []struct {
+		name      string
+		response  string
+		wantFound []bool
+	}{
+		{"all found", `{"tracks":[` + track(idA) + `,` + track(idB) + `,` + track(idC) + `]}`, []bool{true, true, true}},
+		{"null in the middle", `{"tracks":[` + track(idA) + `,null,` + track(idC) + `]}`, []bool{true, false, true}},
+		{"null first and last", `{"tracks":[null,` + track(idB) + `,null]}`, []bool{false, true, false}},
+		{"all null", `{"tracks":[null,null,null]}`, []bool{false, false, false}},
+		{"short response", `{"tracks":[` + track(idA) + `]}`, []bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested string
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/tracks": func(w http.ResponseWriter, r *http.Request) {
+					requested = r.URL.Query().Get("ids")
+					serveJSON(tt.response)(w, r)
+				},
+			}))
+
+			var response TracksResponse
+			if status := get(t, handleTracks, "/spotify/tracks?ids="+idA+","+idB+","+idC, &response); status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if requested != idA+","+idB+","+idC {
+				t.Errorf("requested ids %q", requested)
+			}
+			if len(response.Tracks) != 3 {
+				t.Fatalf("got %d tracks, want 3", len(response.Tracks))
+			}
+			for i, id := range []string{idA, idB, idC} {
+				got := response.Tracks[i]
+				if got.ID != id || got.Found != tt.wantFound[i] {
+					t.Errorf("tracks[%d] = {id %q, found %v}, want {id %q, found %v}", i, got.ID, got.Found, id, tt.wantFound[i])
+				}
+				if got.Found && got.TrackInfo.Name != "Track "+id {
+					t.Errorf("tracks[%d] has name %q, want that of %s", i, got.TrackInfo.Name, id)
+				}
+				if !got.Found && got.TrackInfo != nil {
+					t.Errorf("tracks[%d] isn't found but has %+v", i, got.TrackInfo)
+				}
+			}
+		})
+	}
+}
+
+func TestOversizedBodies(t *testing.T) {
+	previous := maxBodyBytes
+	maxBodyBytes = 64
+	defer func() { maxBodyBytes = previous }()
+
+	handlers := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"create playlist", handleCreatePlaylist},
+		{"add tracks", handleAddTracks},
+		{"resolve batch", handleResolveBatch},
+		{"normalize ids", handleNormalizeIDs},
+		{"watch artist", createWatch},
+	}
+	bodies := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"oversized", `{"ids":["` + strings.Repeat("x", 100) + `"]}`, http.StatusRequestEntityTooLarge},
+		{"oversized whitespace", `{"ids":[]}` + strings.Repeat(" ", 100), http.StatusRequestEntityTooLarge},
+		{"malformed", `{"ids":`, http.StatusBadRequest},
+		{"trailing data", `{"ids":[]} {}`, http.StatusBadRequest},
+	}
+	for _, h := range handlers {
+		for _, b := range bodies {
+			t.Run(h.name+"/"+b.name, func(t *testing.T) {
+				recorder := httptest.NewRecorder()
+				h.handler(recorder, httptest.NewRequest(http.MethodPost, "/spotify/test?id=x", strings.NewReader(b.body)))
+				if recorder.Code != b.status {
+					t.Errorf("status = %d, want %d: %s", recorder.Code, b.status, recorder.Body.String())
+				}
+			})
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handleNormalizeIDs(recorder, httptest.NewRequest(http.MethodPost, "/spotify/normalize-ids", strings.NewReader(`{"ids":["11dFghVXANMlKmJXsNCbNl"]}`)))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("body within the limit: status = %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestResolveShareLinkVariants(t *testing.T) {
+	const id = "11dFghVXANMlKmJXsNCbNl"
+	tests := []struct {
+		link     string
+		wantType string
+	}{
+		{"https://open.spotify.com/track/" + id, "track"},
+		{"https://open.spotify.com/track/" + id + "?si=4f2a9c1b3e5d4a7b", "track"},
+		{"https://open.spotify.com/track/" + id + "?si=abc&utm_source=copy-link#t=30", "track"},
+		{"https://open.spotify.com/intl-de/album/" + id + "?si=abc", "album"},
+		{"https://open.spotify.com/intl-pt_BR/artist/" + id, "artist"},
+		{"https://open.spotify.com/user/spotify/playlist/" + id + "?si=abc", "playlist"},
+		{"https://open.spotify.com/show/" + id + "/", "show"},
+		{"http://open.spotify.com/episode/" + id, "episode"},
+		{"https://play.spotify.com/track/" + id, "track"},
+		{"open.spotify.com/track/" + id + "?si=abc", "track"},
+		{"  https://open.spotify.com/track/" + id + "  ", "track"},
+		{"spotify:track:" + id, "track"},
+		{"spotify:user:spotify:playlist:" + id, "playlist"},
+		{"https://example.com/track/" + id, ""},
+		{"https://open.spotify.com.evil.example/track/" + id, ""},
+		{"ftp://open.spotify.com/track/" + id, ""},
+		{"https://open.spotify.com/track/tooShort", ""},
+		{"https://open.spotify.com/concert/" + id, ""},
+		{"https://open.spotify.com/user/spotify", ""},
+		{"https://open.spotify.com/intl-deutsch/track/" + id, ""},
+		{"spotify:track:", ""},
+		{id, ""},
+	}
+	client := mockSpotify(t, map[string]http.HandlerFunc{
+		"/v1/": func(w http.ResponseWriter, r *http.Request) {
+			parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+			if len(parts) != 2 || parts[1] != id {
+				serveError(http.StatusNotFound)(w, r)
+				return
+			}
+			serveJSON(`{"id":"`+id+`","name":"`+parts[0]+`"}`)(w, r)
+		},
+	})
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			kind, gotID, ok := parseShareLink(tt.link)
+			if ok != (tt.wantType != "") || kind != tt.wantType {
+				t.Fatalf("parseShareLink() = %q, %q, %v, want type %q", kind, gotID, ok, tt.wantType)
+			}
+
+			resolved, err := resolveLink(context.Background(), client, tt.link, "")
+			if tt.wantType == "" {
+				if err != errInvalidShareLink {
+					t.Errorf("resolveLink() error = %v, want errInvalidShareLink", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveLink() error = %v", err)
+			}
+			wantURL := "https://open.spotify.com/" + tt.wantType + "/" + id
+			if resolved.Type != tt.wantType || resolved.ID != id || resolved.URL != wantURL {
+				t.Errorf("resolveLink() = %s %s %s, want %s %s %s", resolved.Type, resolved.ID, resolved.URL, tt.wantType, id, wantURL)
+			}
+			if resolved.Item == nil {
+				t.Error("resolveLink() returned no item")
+			}
+		})
+	}
+}
+
+func TestFetchFullAlbumsConcurrentlyInOrder(t *testing.T) {
+	ids := make([]string, maxAlbumsPerRequest+5)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("album%017d", i)
+	}
+	tests := []struct {
+		name         string
+		unknown      map[string]bool
+		long         map[string]bool
+		failBatch    bool
+		wantMissing  map[int]bool
+		wantWarnings int
+	}{
+		{name: "two batches"},
+		{name: "unknown album", unknown: map[string]bool{ids[3]: true}, wantMissing: map[int]bool{3: true}},
+		{name: "failed batch", failBatch: true, wantMissing: map[int]bool{20: true, 21: true, 22: true, 23: true, 24: true}, wantWarnings: 1},
+		{name: "long albums", long: map[string]bool{ids[0]: true, ids[21]: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := rendezvous(t, 2)
+			trackPages := rendezvous(t, len(tt.long))
+			client := mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/albums": func(w http.ResponseWriter, r *http.Request) {
+					batches()
+					requested := strings.Split(r.URL.Query().Get("ids"), ",")
+					if tt.failBatch && requested[0] == ids[maxAlbumsPerRequest] {
+						serveError(http.StatusInternalServerError)(w, r)
+						return
+					}
+					albums := make([]string, len(requested))
+					for i, id := range requested {
+						next := ""
+						if tt.long[id] {
+							next = "https://api.spotify.com/v1/albums/" + id + "/tracks?offset=50&limit=50"
+						}
+						albums[i] = `{"id":"` + id + `","name":"` + id + `","tracks":{"items":[{"id":"first"}],"next":"` + next + `"}}`
+						if tt.unknown[id] {
+							albums[i] = "null"
+						}
+					}
+					serveJSON(`{"albums":[`+strings.Join(albums, ",")+`]}`)(w, r)
+				},
+				"/v1/albums/": func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Query().Get("offset") != "" {
+						serveJSON(`{"items":[{"id":"second"}]}`)(w, r)
+						return
+					}
+					trackPages()
+					serveJSON(`{"items":[{"id":"first"}],"next":"https://api.spotify.com`+r.URL.Path+`?offset=50&limit=50"}`)(w, r)
+				},
+			})
+
+			var failures subCallFailures
+			albums := fetchFullAlbums(context.Background(), client, ids, "", &failures)
+			if len(albums) != len(ids) {
+				t.Fatalf("got %d albums, want %d", len(albums), len(ids))
+			}
+			for i, album := range albums {
+				if tt.wantMissing[i] {
+					if album != nil {
+						t.Errorf("albums[%d] = %s, want nil", i, album.ID)
+					}
+					continue
+				}
+				if album == nil || album.ID != ids[i] {
+					t.Errorf("albums[%d] = %+v, want %s", i, album, ids[i])
+					continue
+				}
+				wantTracks := 1
+				if tt.long[album.ID] {
+					wantTracks = 2
+				}
+				if len(album.Tracks.Items) != wantTracks || album.Tracks.Next != "" {
+					t.Errorf("albums[%d] has %d tracks and next %q, want %d tracks", i, len(album.Tracks.Items), album.Tracks.Next, wantTracks)
+				}
+			}
+			if len(failures.warnings) != tt.wantWarnings {
+				t.Errorf("warnings = %q, want %d", failures.warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONWithBOM(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	tests := []struct {
+		name     string
+		body     string
+		wantName string
+		wantErr  []string
+		notInErr string
+	}{
+		{name: "plain", body: `{"name":"After Hours"}`, wantName: "After Hours"},
+		{name: "BOM", body: bom + `{"name":"After Hours"}`, wantName: "After Hours"},
+		{name: "BOM and trailing whitespace", body: bom + `{"name":"After Hours"}` + " \r\n\t", wantName: "After Hours"},
+		{name: "BOM inside the value kept", body: `{"name":"` + bom + `After Hours"}`, wantName: bom + "After Hours"},
+		{name: "proxy error page", body: "<html><body>502 Bad Gateway</body></html>", wantErr: []string{"decoding Spotify response", `<html><body>502 Bad Gateway`}},
+		{name: "credentials redacted", body: `{"access_token":"s3cr3t","client_secret":"hunter2",`, wantErr: []string{`access_token\":\"[REDACTED]`, `client_secret\":\"[REDACTED]`}, notInErr: "s3cr3t"},
+		{name: "long body cut", body: "<" + strings.Repeat("x", 500), wantErr: []string{strings.Repeat("x", maxBodySnippet-1) + `"`}, notInErr: strings.Repeat("x", maxBodySnippet)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := mockSpotify(t, map[string]http.HandlerFunc{"/v1/albums/": serveJSON(tt.body)})
+			for source, decode := range map[string]func(v interface{}) error{
+				"decodeJSON": func(v interface{}) error { return decodeJSON([]byte(tt.body), v) },
+				"getJSON":    func(v interface{}) error { return client.getJSON(context.Background(), "/albums/a", v) },
+			} {
+				var album struct {
+					Name string `json:"name"`
+				}
+				err := decode(&album)
+				if tt.wantErr == nil {
+					if err != nil || album.Name != tt.wantName {
+						t.Errorf("%s: name %q, error %v, want %q", source, album.Name, err, tt.wantName)
+					}
+					continue
+				}
+				if err == nil {
+					t.Fatalf("%s: decoding succeeded, want an error", source)
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("%s: error %q doesn't contain %q", source, err, want)
+					}
+				}
+				if tt.notInErr != "" && strings.Contains(err.Error(), tt.notInErr) {
+					t.Errorf("%s: error %q contains %q", source, err, tt.notInErr)
+				}
+			}
+		})
+	}
+}
+
+func TestFlakyAuth(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		status       int
+		authRetries  int
+		timeout      time.Duration
+		wantRequests int
+		wantStatus   int
+		wantAttempts int
+	}{
+		{name: "healthy", wantRequests: 1},
+		{name: "one server error", failures: 1, status: http.StatusServiceUnavailable, authRetries: 5, wantRequests: 2},
+		{name: "one rate limit", failures: 1, status: http.StatusTooManyRequests, authRetries: 5, wantRequests: 2},
+		{name: "retries exhausted", failures: -1, status: http.StatusInternalServerError, authRetries: 1, wantRequests: 2, wantStatus: http.StatusInternalServerError, wantAttempts: 2},
+		{name: "rejected credentials", failures: -1, status: http.StatusBadRequest, authRetries: 5, wantRequests: 1, wantStatus: http.StatusBadRequest, wantAttempts: 1},
+		// The refresh is shared, so it carries on for other callers, but
+		// the cancelled caller stops waiting for it.
+		{name: "cancelled while waiting", failures: -1, status: http.StatusServiceUnavailable, authRetries: 5, timeout: 100 * time.Millisecond, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			client := mockSpotify(t, map[string]http.HandlerFunc{
+				"/api/token": func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests++
+					fail := tt.failures < 0 || requests <= tt.failures
+					mu.Unlock()
+					if fail {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(tt.status)
+						w.Write([]byte(`{"error":"invalid_client","error_description":"Invalid client"}`))
+						return
+					}
+					serveJSON(testToken)(w, r)
+				},
+				"/v1/tracks/": func(w http.ResponseWriter, r *http.Request) {
+					if r.Header.Get("Authorization") != "Bearer test-token" {
+						serveError(http.StatusUnauthorized)(w, r)
+						return
+					}
+					serveJSON(`{"id":"t1"}`)(w, r)
+				},
+			})
+			client.AuthRetries = tt.authRetries
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			_, err := client.get(ctx, "/tracks/t1")
+			mu.Lock()
+			if requests != tt.wantRequests {
+				t.Errorf("made %d token requests, want %d", requests, tt.wantRequests)
+			}
+			mu.Unlock()
+			if tt.timeout > 0 {
+				if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > tt.timeout+200*time.Millisecond {
+					t.Errorf("get() = %v after %v, want the deadline error soon after %v", err, time.Since(start), tt.timeout)
+				}
+				return
+			}
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("get() error = %v", err)
+				}
+				return
+			}
+			var authErr *AuthError
+			if !errors.As(err, &authErr) {
+				t.Fatalf("get() error = %v, want an AuthError", err)
+			}
+			if authErr.Status != tt.wantStatus || authErr.Attempts != tt.wantAttempts || authErr.Message != "invalid_client Invalid client" {
+				t.Errorf("AuthError = %+v, want status %d after %d attempts", authErr, tt.wantStatus, tt.wantAttempts)
+			}
+			recorder := httptest.NewRecorder()
+			writeUpstreamError(recorder, httptest.NewRequest(http.MethodGet, "/spotify/tracks", nil), err)
+			if recorder.Code != http.StatusBadGateway || !strings.Contains(recorder.Body.String(), "spotify authentication failed") {
+				t.Errorf("reported as %d %s, want 502 naming the authentication failure", recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestConcurrentCallsShareOneTokenRequest(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	client := mockSpotify(t, map[string]http.HandlerFunc{
+		"/api/token": func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			serveJSON(testToken)(w, r)
+		},
+		"/v1/tracks/": serveJSON(`{"id":"t1"}`),
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.get(context.Background(), "/tracks/t1"); err != nil {
+				t.Errorf("get() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("made %d token requests, want 1", requests)
+	}
+}
+
+func TestDurationFormats(t *testing.T) {
+	tests := []struct {
+		ms      int
+		legacy  string
+		clock   string
+		iso8601 string
+	}{
+		{0, "0:00", "0:00", "PT0S"},
+		{999, "0:00", "0:00", "PT0S"},
+		{59999, "0:59", "0:59", "PT59S"},
+		{60000, "1:00", "1:00", "PT1M"},
+		{200040, "3:20", "3:20", "PT3M20S"},
+		{3599999, "59:59", "59:59", "PT59M59S"},
+		{3600000, "60:00", "1:00:00", "PT1H"},
+		{3725000, "62:05", "1:02:05", "PT1H2M5S"},
+		{3605000, "60:05", "1:00:05", "PT1H5S"},
+		{36000000, "600:00", "10:00:00", "PT10H"},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.ms), func(t *testing.T) {
+			if got := formatDuration(tt.ms); got != tt.legacy {
+				t.Errorf("formatDuration(%d) = %q, want %q", tt.ms, got, tt.legacy)
+			}
+			if got := formatClockDuration(tt.ms); got != tt.clock {
+				t.Errorf("formatClockDuration(%d) = %q, want %q", tt.ms, got, tt.clock)
+			}
+			if got := formatISODuration(tt.ms); got != tt.iso8601 {
+				t.Errorf("formatISODuration(%d) = %q, want %q", tt.ms, got, tt.iso8601)
+			}
+
+			response := map[string]interface{}{
+				"track": TrackInfo{Name: "Track", Duration: formatDuration(tt.ms), DurationMs: tt.ms},
+				"album": map[string]interface{}{"tracks": []TrackBasic{{Name: "Album track", Duration: tt.ms, TrackNumber: 1}}},
+			}
+			for format, want := range map[string]string{"ms": strconv.Itoa(tt.ms), "clock": strconv.Quote(tt.clock), "iso8601": strconv.Quote(tt.iso8601)} {
+				formatted, err := withDurationFormat(response, format)
+				if err != nil {
+					t.Fatalf("withDurationFormat(%s) error = %v", format, err)
+				}
+				raw, err := json.Marshal(formatted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantFields := `"duration":` + want + `,"duration_ms":` + strconv.Itoa(tt.ms)
+				if n := strings.Count(string(raw), wantFields); n != 2 {
+					t.Errorf("duration_format=%s: %s has %s %d times, want on both the track and the album track", format, raw, wantFields, n)
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownDurationFormat(t *testing.T) {
+	handler := durationFormatHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, http.StatusOK, map[string]interface{}{"success": true})
+	}))
+	for format, want := range map[string]int{
+		"":        http.StatusOK,
+		"ms":      http.StatusOK,
+		"clock":   http.StatusOK,
+		"iso8601": http.StatusOK,
+		"seconds": http.StatusBadRequest,
+		"ISO8601": http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/spotify/songs?duration_format="+format, nil))
+		if recorder.Code != want {
+			t.Errorf("duration_format=%s: status = %d, want %d", format, recorder.Code, want)
+		}
+	}
+}
+
+func TestRestrictions(t *testing.T) {
+	const id = "11dFghVXANMlKmJXsNCbNl"
+	tests := []struct {
+		name         string
+		restrictions string
+		want         string
+	}{
+		{"market", `,"restrictions":{"reason":"market"}`, `"restrictions":{"reason":"market"}`},
+		{"product", `,"restrictions":{"reason":"product"}`, `"restrictions":{"reason":"product"}`},
+		{"explicit", `,"restrictions":{"reason":"explicit"}`, `"restrictions":{"reason":"explicit"}`},
+		{"unknown reason kept", `,"restrictions":{"reason":"payment_required"}`, `"restrictions":{"reason":"payment_required"}`},
+		{"absent", ``, ``},
+		{"null", `,"restrictions":null`, ``},
+		{"empty", `,"restrictions":{}`, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := `{"id":"` + id + `","name":"Restricted","is_playable":false,"album":{"id":"` + id + `","name":"Album"` + tt.restrictions + `}` + tt.restrictions + `}`
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/tracks":       serveJSON(`{"tracks":[` + fixture + `]}`),
+				"/v1/albums/" + id: serveJSON(`{"id":"` + id + `","name":"Album","tracks":{"items":[]}` + tt.restrictions + `}`),
+			}))
+
+			var track json.RawMessage
+			if status := get(t, handleTracks, "/spotify/tracks?ids="+id, &track); status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, track)
+			}
+			var album json.RawMessage
+			if status := get(t, handleAlbum, "/spotify/album?id="+id, &album); status != http.StatusOK {
+				t.Fatalf("status = %d: %s", status, album)
+			}
+			for name, body := range map[string]json.RawMessage{"track": track, "album": album} {
+				if tt.want == "" {
+					if strings.Contains(string(body), `"restrictions"`) {
+						t.Errorf("%s response %s has restrictions, want none", name, body)
+					}
+				} else if !strings.Contains(string(body), tt.want) {
+					t.Errorf("%s response %s doesn't have %s", name, body, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecommendationTunables(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantFields []string
+		wantParams map[string]string
+	}{
+		{"valid", "seed_genres=pop&min_energy=0.2&target_energy=0.5&max_energy=0.8&target_tempo=120&target_key=5",
+			nil, map[string]string{"min_energy": "0.2", "target_energy": "0.5", "max_energy": "0.8", "target_tempo": "120", "target_key": "5", "seed_genres": "pop", "limit": "20"}},
+		{"equal bounds", "min_popularity=50&target_popularity=50&max_popularity=50", nil, map[string]string{"min_popularity": "50", "target_popularity": "50", "max_popularity": "50", "limit": "20"}},
+		{"min above max", "min_energy=0.8&max_energy=0.2", []string{"min_energy"}, nil},
+		{"target below min", "min_tempo=100&target_tempo=50", []string{"target_tempo"}, nil},
+		{"target above max", "target_tempo=200&max_tempo=150", []string{"target_tempo"}, nil},
+		{"out of range", "max_energy=1.5", []string{"max_energy"}, nil},
+		{"negative loudness in range", "target_loudness=-12", nil, map[string]string{"target_loudness": "-12", "limit": "20"}},
+		{"loudness above range", "target_loudness=3", []string{"target_loudness"}, nil},
+		{"key above range", "target_key=12", []string{"target_key"}, nil},
+		{"fractional integer", "target_key=1.5", []string{"target_key"}, nil},
+		{"time signature below range", "min_time_signature=2", []string{"min_time_signature"}, nil},
+		{"not a number", "target_valence=high", []string{"target_valence"}, nil},
+		{"too many seeds", "seed_artists=a,b,c&seed_tracks=d,e,f", []string{"seeds"}, nil},
+		{"empty seed", "seed_artists=a,,b", []string{"seed_artists"}, nil},
+		{"every invalid tunable listed", "min_energy=0.9&max_energy=0.1&target_key=20&max_danceability=2", []string{"min_energy", "target_key", "max_danceability"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/spotify/me/recommendations?dry_run=true&" + tt.query
+			if tt.wantFields != nil {
+				var response ValidationErrorResponse
+				if status := get(t, handleRecommendations, target, &response); status != http.StatusBadRequest {
+					t.Fatalf("status = %d, want 400", status)
+				}
+				var fields []string
+				for _, detail := range response.Details {
+					fields = append(fields, detail.Field)
+				}
+				sort.Strings(fields)
+				want := append([]string{}, tt.wantFields...)
+				sort.Strings(want)
+				if strings.Join(fields, ",") != strings.Join(want, ",") {
+					t.Errorf("invalid fields %v, want %v: %+v", fields, want, response.Details)
+				}
+				return
+			}
+
+			var response RecommendationsDryRunResponse
+			if status := get(t, handleRecommendations, target, &response); status != http.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			if len(response.Parameters) != len(tt.wantParams) {
+				t.Errorf("parameters %v, want %v", response.Parameters, tt.wantParams)
+			}
+			for field, want := range tt.wantParams {
+				if response.Parameters[field] != want {
+					t.Errorf("%s = %q, want %q", field, response.Parameters[field], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	const id = "11dFghVXANMlKmJXsNCbNl"
+	tests := []struct {
+		raw     string
+		kind    string
+		want    string
+		wantErr string
+	}{
+		{id, "", id, ""},
+		{"  " + id + " ", "track", id, ""},
+		{"spotify:track:" + id, "", id, ""},
+		{"spotify:track:" + id, "track", id, ""},
+		{"https://open.spotify.com/track/" + id + "?si=abc", "track", id, ""},
+		{"https://open.spotify.com/intl-fr/album/" + id, "album", id, ""},
+		{"open.spotify.com/episode/" + id, "episode", id, ""},
+		{"https://open.spotify.com/user/spotify/playlist/" + id, "playlist", id, ""},
+		{"spotify:album:" + id, "track", "", "album link, not a track"},
+		{"https://open.spotify.com/artist/" + id, "show", "", "artist link, not a show"},
+		{"", "", "", "empty entry"},
+		{"   ", "track", "", "empty entry"},
+		{"tooShort", "track", "", "not a 22-character Spotify id"},
+		{id + "x", "", "", "not a 22-character Spotify id"},
+		{"11dFghVXANMlKmJXsNCb-l", "", "", "not a 22-character Spotify id"},
+		{"https://example.com/track/" + id, "track", "", "not a 22-character Spotify id"},
+		{"spotify_user.42", "user", "spotify_user.42", ""},
+		{"spotify:user:spotify_user.42", "user", "spotify_user.42", ""},
+		{id, "user", id, ""},
+		{"spotify:track:" + id, "user", "", "track link, not a user"},
+		{"https://open.spotify.com/user/someone", "user", "", "not a Spotify user id or URI"},
+		{"spotify:user:", "user", "", "not a Spotify user id or URI"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+"/"+tt.raw, func(t *testing.T) {
+			got, err := normalizeID(tt.raw, tt.kind)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("normalizeID(%q, %q) = %q, %v, want error %q", tt.raw, tt.kind, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("normalizeID(%q, %q) = %q, %v, want %q", tt.raw, tt.kind, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchIDsNormalized(t *testing.T) {
+	const (
+		idA = "11dFghVXANMlKmJXsNCbNl"
+		idB = "0VjIjW4GlUZAMYd2vXMi3b"
+	)
+	tests := []struct {
+		name    string
+		ids     string
+		kind    string
+		want    []string
+		wantErr bool
+	}{
+		{"bare ids", idA + "," + idB, "track", []string{idA, idB}, false},
+		{"mixed forms", "spotify:track:" + idA + "," + url.QueryEscape("https://open.spotify.com/track/"+idB+"?si=x"), "track", []string{idA, idB}, false},
+		{"wrong link type", idA + ",spotify:album:" + idB, "track", nil, true},
+		{"empty entry", idA + ",," + idB, "track", nil, true},
+		{"too many", idA + "," + idB + "," + idA, "track", nil, true},
+		{"invalid id", idA + ",nope", "artist", nil, true},
+		{"user ids", "spotify_user.42,spotify:user:other", "user", []string{"spotify_user.42", "other"}, false},
+		{"artist link for users", "spotify:artist:" + idA, "user", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &validator{}
+			got := v.ids(httptest.NewRequest(http.MethodGet, "/spotify/tracks?ids="+tt.ids, nil), tt.kind, 2)
+			if v.valid() == tt.wantErr {
+				t.Fatalf("ids() valid = %v with errors %+v, want error: %v", v.valid(), v.errors, tt.wantErr)
+			}
+			if !tt.wantErr && strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ids() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A rejected entry fails the request before Spotify is called.
+	useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+		"/v1/": func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("called Spotify for %s", r.URL)
+			serveError(http.StatusInternalServerError)(w, r)
+		},
+	}))
+	var response ValidationErrorResponse
+	if status := get(t, handleTracks, "/spotify/tracks?ids=spotify:album:"+idA, &response); status != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", status)
+	}
+	if len(response.Details) != 1 || response.Details[0].Field != "ids" || !strings.Contains(response.Details[0].Message, "album link, not a track") {
+		t.Errorf("details = %+v, want the album link rejected", response.Details)
+	}
+}
+
+func TestSingleIDNormalized(t *testing.T) {
+	const id = "11dFghVXANMlKmJXsNCbNl"
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		want    string // Spotify path looked up, or "" for a 400
+	}{
+		{"bare id", handleSpotifySongs, "/spotify/songs?id=" + id, "/v1/tracks/" + id},
+		{"uri", handleSpotifySongs, "/spotify/songs?id=spotify:track:" + id, "/v1/tracks/" + id},
+		{"link", handleAlbum, "/spotify/album?id=" + url.QueryEscape("https://open.spotify.com/album/"+id+"?si=x"), "/v1/albums/" + id},
+		{"playlist uri", handlePlaylist, "/spotify/playlist?id=spotify:playlist:" + id, "/v1/playlists/" + id},
+		{"wrong type", handleTrackAlbum, "/spotify/track/album?id=spotify:album:" + id, ""},
+		{"invalid", handleSimilarTracks, "/spotify/similar-tracks?id=nope", ""},
+		{"too long", handleMoreAlbums, "/spotify/album/more?id=" + strings.Repeat("a", 8000), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called []string
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/": func(w http.ResponseWriter, r *http.Request) {
+					called = append(called, r.URL.Path)
+					serveError(http.StatusNotFound)(w, r)
+				},
+			}))
+			var response ValidationErrorResponse
+			status := get(t, tt.handler, tt.target, &response)
+			if tt.want == "" {
+				if status != http.StatusBadRequest || len(called) != 0 {
+					t.Fatalf("status = %d after calling %v, want 400 without calling Spotify", status, called)
+				}
+				if len(response.Details) != 1 || response.Details[0].Field != "id" {
+					t.Errorf("details = %+v, want only the id rejected", response.Details)
+				}
+				return
+			}
+			if len(called) == 0 || called[0] != tt.want {
+				t.Errorf("called %v, want %s first", called, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlbumEditionsDropsQuotes(t *testing.T) {
+	tests := []struct {
+		name      string
+		album     string
+		wantQuery string // "" for a 400
+	}{
+		{"plain", "After Hours", `album:"After Hours" artist:"The Weeknd"`},
+		{"quoted", `After "Hours"`, `album:"After Hours" artist:"The Weeknd"`},
+		{"closing quote", `x" label:"y`, `album:"x label:y" artist:"The Weeknd"`},
+		{"only quotes", `""`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			useClient(t, mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/search": func(w http.ResponseWriter, r *http.Request) {
+					query = r.URL.Query().Get("q")
+					serveJSON(`{"albums":{"items":[]}}`)(w, r)
+				},
+			}))
+			var response AlbumEditionsResponse
+			status := get(t, handleAlbumEditions, "/spotify/album/upc?artist=The+Weeknd&album="+url.QueryEscape(tt.album), &response)
+			if tt.wantQuery == "" {
+				if status != http.StatusBadRequest || query != "" {
+					t.Fatalf("status = %d after searching %q, want 400 without searching", status, query)
+				}
+				return
+			}
+			if query != tt.wantQuery {
+				t.Errorf("searched %q, want %q", query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestStaleHitsShareOneRevalidation(t *testing.T) {
+	const endpoint = "/albums/11dFghVXANMlKmJXsNCbNl"
+	tests := []struct {
+		name         string
+		staleTimeout time.Duration
+		delay        time.Duration
+		want         string
+	}{
+		{"refreshed in time", time.Second, 200 * time.Millisecond, `{"name":"fresh"}`},
+		{"served stale", 20 * time.Millisecond, 300 * time.Millisecond, `{"name":"stale"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			client := mockSpotify(t, map[string]http.HandlerFunc{
+				"/v1/albums/": func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests++
+					mu.Unlock()
+					time.Sleep(tt.delay)
+					serveJSON(`{"name":"fresh"}`)(w, r)
+				},
+			})
+			client.Cache = newResponseCache(1 << 20)
+			client.CacheTTL = time.Minute
+			client.StaleTimeout = tt.staleTimeout
+			client.Cache.Set(endpoint, cachedResponse{Data: []byte(`{"name":"stale"}`), FreshUntil: time.Now().Add(-time.Second)}, time.Minute)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					data, err := client.get(context.Background(), endpoint)
+					if err != nil || string(data) != tt.want {
+						t.Errorf("get() = %s, %v, want %s", data, err, tt.want)
+					}
+				}()
+			}
+			wg.Wait()
+
+			// Let a refresh that outlived the requests finish.
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if cached, _ := client.Cache.Get(endpoint); string(cached.Data) == `{"name":"fresh"}` {
+					break
+				}
+			}
+			if cached, _ := client.Cache.Get(endpoint); string(cached.Data) != `{"name":"fresh"}` {
+				t.Errorf("cache holds %s after the refresh, want the fresh response", cached.Data)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if requests != 1 {
+				t.Errorf("made %d upstream requests, want 1", requests)
+			}
+		})
+	}
+}